@@ -0,0 +1,133 @@
+package lshensemble
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+var (
+	errQuerySize       = errors.New("Query domain size must be positive")
+	errQueryThreshold  = errors.New("Query threshold must be in [0, 1]")
+	errQuerySignatures = errors.New("Query signature has fewer hash values than the index")
+)
+
+// QuerySpec is a query of QueryBatch, given the MinHash signature of the
+// query domain, the domain size, and the containment threshold.
+// Objective is the objective of choosing the LSH parameters of the query,
+// if nil, the objective of the index is used.
+type QuerySpec struct {
+	Signature []uint64
+	Size      int
+	Threshold float64
+	Objective *Objective
+}
+
+// QueryResultOf is the result of a query of QueryBatch, which has the
+// candidate domain keys of type K, or the error of an invalid query.
+type QueryResultOf[K comparable] struct {
+	Keys []K
+	Err  error
+}
+
+// QueryResult is the result of a query of QueryBatch, which has the
+// candidate domain keys, or the error of an invalid query.
+type QueryResult = QueryResultOf[interface{}]
+
+// queryGroup is the queries with the same domain size, threshold and
+// objective, whose LSH parameters are computed once.
+type queryGroup struct {
+	size      int
+	threshold float64
+	objective Objective
+	once      sync.Once
+	params    []param
+}
+
+// QueryBatch runs the queries using at most workers goroutines, and returns
+// the results in the order of the queries.
+// The LSH parameters are computed once for all queries with the same
+// domain size, threshold and objective, and the partitions are searched one after
+// another for every query rather than in parallel.
+// If workers is not positive, GOMAXPROCS goroutines are used.
+func (e *LshEnsembleOf[K]) QueryBatch(queries []QuerySpec, workers int) []QueryResultOf[K] {
+	results := make([]QueryResultOf[K], len(queries))
+	type groupKey struct {
+		size      int
+		threshold float64
+		objective Objective
+	}
+	groups := make(map[groupKey]*queryGroup)
+	queryGroups := make([]*queryGroup, len(queries))
+	for i, q := range queries {
+		if err := e.validateQuery(q); err != nil {
+			results[i].Err = err
+			continue
+		}
+		obj := e.objective
+		if q.Objective != nil {
+			obj = *q.Objective
+		}
+		key := groupKey{q.Size, q.Threshold, obj}
+		if _, exists := groups[key]; !exists {
+			groups[key] = &queryGroup{size: q.Size, threshold: q.Threshold, objective: obj}
+		}
+		queryGroups[i] = groups[key]
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				g := queryGroups[i]
+				g.once.Do(func() {
+					g.params = e.computeParams(g.size, g.threshold, containmentMeasure, g.objective)
+				})
+				results[i].Keys = e.querySequential(queries[i].Signature, g.params)
+			}
+		}()
+	}
+	for i := range queries {
+		if queryGroups[i] != nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func (e *LshEnsembleOf[K]) validateQuery(q QuerySpec) error {
+	if q.Size <= 0 {
+		return errQuerySize
+	}
+	if q.Threshold < 0.0 || q.Threshold > 1.0 {
+		return errQueryThreshold
+	}
+	if len(q.Signature) < e.numHash {
+		return errQuerySignatures
+	}
+	return nil
+}
+
+// querySequential returns the candidate domain keys from all partitions,
+// which are searched one after another.
+func (e *LshEnsembleOf[K]) querySequential(sig []uint64, params []param) []K {
+	keyChan := make(chan K)
+	go func() {
+		for i := range e.lshes {
+			e.lshes[i].Query(sig, params[i].k, params[i].l, keyChan, nil)
+		}
+		close(keyChan)
+	}()
+	keys := make([]K, 0)
+	for key := range keyChan {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,48 @@
+package lshensemble
+
+import (
+	"testing"
+)
+
+func Test_LshEnsembleQueryBatch(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []QuerySpec
+	for _, rec := range recs {
+		// Repeated queries share the LSH parameters.
+		for _, threshold := range []float64{0.5, 0.5, 0.9} {
+			queries = append(queries, QuerySpec{rec.Signature, rec.Size, threshold, nil})
+		}
+	}
+	invalid := []QuerySpec{
+		{recs[0].Signature, 0, 0.5, nil},
+		{recs[0].Signature, recs[0].Size, 1.5, nil},
+		{recs[0].Signature[:64], recs[0].Size, 0.5, nil},
+	}
+	queries = append(queries, invalid...)
+	for _, workers := range []int{0, 1, 3} {
+		results := index.QueryBatch(queries, workers)
+		if len(results) != len(queries) {
+			t.Fatalf("Expected %d results, got %d", len(queries), len(results))
+		}
+		for i, q := range queries[:len(queries)-len(invalid)] {
+			if results[i].Err != nil {
+				t.Fatal(results[i].Err)
+			}
+			expected, _ := index.QueryTimed(q.Signature, q.Size, q.Threshold)
+			if !sameKeys(expected, results[i].Keys) {
+				t.Fatalf("Query results mismatch %v, %v", expected, results[i].Keys)
+			}
+		}
+		expectedErrs := []error{errQuerySize, errQueryThreshold, errQuerySignatures}
+		for i, err := range expectedErrs {
+			if result := results[len(queries)-len(invalid)+i]; result.Err != err || result.Keys != nil {
+				t.Errorf("Expected error %v, got %v", err, result.Err)
+			}
+		}
+	}
+}
@@ -1,18 +1,34 @@
 package lshensemble
 
-import "errors"
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+)
 
 var (
 	errDomainSizeOrder = errors.New("Domain records must be sorted in ascending order of size")
+	errNoDomainRecords = errors.New("No domain records to build the index from")
 )
 
-func bootstrapOptimalPartitions(domains <-chan *DomainRecord, numPart int) ([]Partition, int) {
+func bootstrapOptimalPartitions[K comparable](domains <-chan *DomainRecordOf[K], numPart int, opts []Option) ([]Partition, int) {
 	sizes, counts := computeSizeDistribution(domains)
-	partitions := optimalPartitions(sizes, counts, numPart)
+	partitions := partitionSizes(sizes, counts, numPart, opts)
 	return partitions, len(sizes)
 }
 
-func bootstrapOptimal(index *LshEnsemble, sortedDomains <-chan *DomainRecord) error {
+// partitionSizes computes the optimal partitions of the size distribution,
+// which are approximate if WithApproximatePartitioning is given.
+func partitionSizes(sizes, counts []int, numPart int, opts []Option) []Partition {
+	if c := newConfig(opts); c.partitionBins > 0 {
+		return approxOptimalPartitions(sizes, counts, numPart, c.partitionBins)
+	}
+	return optimalPartitions(sizes, counts, numPart)
+}
+
+func bootstrapOptimal[K comparable](index *LshEnsembleOf[K], sortedDomains <-chan *DomainRecordOf[K]) error {
 	var currPart int
 	var currSize int
 	for rec := range sortedDomains {
@@ -28,12 +44,34 @@ func bootstrapOptimal(index *LshEnsemble, sortedDomains <-chan *DomainRecord) er
 				currSize <= index.Partitions[currPart].Upper) {
 			return errors.New("Domain records does not match the existing partitions")
 		}
-		index.Add(rec.Key, rec.Signature, currPart)
+		index.add(rec.Key, rec.Signature, rec.Size, currPart)
 	}
 	index.Index()
+	index.wrapConcurrentInserts()
 	return nil
 }
 
+// BootstrapLshEnsembleOptimalOf builds an index with keys of type K from domains using optimal
+// partitioning.
+// The returned index consists of MinHash LSH implemented using LshForestOf.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash
+// functions per "band".
+// sortedDomainFactory is factory function that returns a DomainRecord channel
+// emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
+func BootstrapLshEnsembleOptimalOf[K comparable](numPart, numHash, maxK int,
+	sortedDomainFactory func() <-chan *DomainRecordOf[K], opts ...Option) (*LshEnsembleOf[K], error) {
+	partitions, count := bootstrapOptimalPartitions(sortedDomainFactory(), numPart, opts)
+	index := newForestEnsemble[K](partitions, numHash, maxK, count, opts)
+	err := bootstrapOptimal(index, sortedDomainFactory())
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
 // BootstrapLshEnsembleOptimal builds an index from domains using optimal
 // partitioning.
 // The returned index consists of MinHash LSH implemented using LshForest.
@@ -43,10 +81,26 @@ func bootstrapOptimal(index *LshEnsemble, sortedDomains <-chan *DomainRecord) er
 // functions per "band".
 // sortedDomainFactory is factory function that returns a DomainRecord channel
 // emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
 func BootstrapLshEnsembleOptimal(numPart, numHash, maxK int,
-	sortedDomainFactory func() <-chan *DomainRecord) (*LshEnsemble, error) {
-	partitions, count := bootstrapOptimalPartitions(sortedDomainFactory(), numPart)
-	index := NewLshEnsemble(partitions, numHash, maxK, count)
+	sortedDomainFactory func() <-chan *DomainRecord, opts ...Option) (*LshEnsemble, error) {
+	return BootstrapLshEnsembleOptimalOf(numPart, numHash, maxK, sortedDomainFactory, opts...)
+}
+
+// BootstrapLshEnsemblePlusOptimalOf builds an index with keys of type K from domains using optimal
+// partitioning.
+// The returned index consists of MinHash LSH implemented using LshForestArrayOf.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash
+// functions per "band".
+// sortedDomainFactory is factory function that returns a DomainRecord channel
+// emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
+func BootstrapLshEnsemblePlusOptimalOf[K comparable](numPart, numHash, maxK int,
+	sortedDomainFactory func() <-chan *DomainRecordOf[K], opts ...Option) (*LshEnsembleOf[K], error) {
+	partitions, count := bootstrapOptimalPartitions(sortedDomainFactory(), numPart, opts)
+	index := newForestArrayEnsemble[K](partitions, numHash, maxK, count, opts)
 	err := bootstrapOptimal(index, sortedDomainFactory())
 	if err != nil {
 		return nil, err
@@ -63,18 +117,13 @@ func BootstrapLshEnsembleOptimal(numPart, numHash, maxK int,
 // functions per "band".
 // sortedDomainFactory is factory function that returns a DomainRecord channel
 // emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
 func BootstrapLshEnsemblePlusOptimal(numPart, numHash, maxK int,
-	sortedDomainFactory func() <-chan *DomainRecord) (*LshEnsemble, error) {
-	partitions, count := bootstrapOptimalPartitions(sortedDomainFactory(), numPart)
-	index := NewLshEnsemblePlus(partitions, numHash, maxK, count)
-	err := bootstrapOptimal(index, sortedDomainFactory())
-	if err != nil {
-		return nil, err
-	}
-	return index, nil
+	sortedDomainFactory func() <-chan *DomainRecord, opts ...Option) (*LshEnsemble, error) {
+	return BootstrapLshEnsemblePlusOptimalOf(numPart, numHash, maxK, sortedDomainFactory, opts...)
 }
 
-func bootstrapEquiDepth(index *LshEnsemble, totalNumDomains int, sortedDomains <-chan *DomainRecord) error {
+func bootstrapEquiDepth[K comparable](index *LshEnsembleOf[K], totalNumDomains int, sortedDomains <-chan *DomainRecordOf[K]) error {
 	numPart := len(index.Partitions)
 	depth := totalNumDomains / numPart
 	var currDepth, currPart int
@@ -84,7 +133,7 @@ func bootstrapEquiDepth(index *LshEnsemble, totalNumDomains int, sortedDomains <
 			return errDomainSizeOrder
 		}
 		currSize = rec.Size
-		index.Add(rec.Key, rec.Signature, currPart)
+		index.add(rec.Key, rec.Signature, rec.Size, currPart)
 		currDepth++
 		index.Partitions[currPart].Upper = rec.Size
 		if currDepth >= depth && currPart < numPart-1 {
@@ -94,9 +143,30 @@ func bootstrapEquiDepth(index *LshEnsemble, totalNumDomains int, sortedDomains <
 		}
 	}
 	index.Index()
+	index.wrapConcurrentInserts()
 	return nil
 }
 
+// BootstrapLshEnsembleEquiDepthOf builds an index with keys of type K from a channel of domains
+// using equi-depth partitions -- partitions have approximately the same
+// number of domains.
+// The returned index consists of MinHash LSH implemented using LshForestOf.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
+// sortedDomains is a DomainRecord channel emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
+func BootstrapLshEnsembleEquiDepthOf[K comparable](numPart, numHash, maxK, totalNumDomains int,
+	sortedDomains <-chan *DomainRecordOf[K], opts ...Option) (*LshEnsembleOf[K], error) {
+	index := newForestEnsemble[K](make([]Partition, numPart), numHash, maxK,
+		totalNumDomains, opts)
+	err := bootstrapEquiDepth(index, totalNumDomains, sortedDomains)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
 // BootstrapLshEnsembleEquiDepth builds an index from a channel of domains
 // using equi-depth partitions -- partitions have approximately the same
 // number of domains.
@@ -105,10 +175,25 @@ func bootstrapEquiDepth(index *LshEnsemble, totalNumDomains int, sortedDomains <
 // numHash is the number of hash functions in MinHash.
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
 // sortedDomains is a DomainRecord channel emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
 func BootstrapLshEnsembleEquiDepth(numPart, numHash, maxK, totalNumDomains int,
-	sortedDomains <-chan *DomainRecord) (*LshEnsemble, error) {
-	index := NewLshEnsemble(make([]Partition, numPart), numHash, maxK,
-		totalNumDomains)
+	sortedDomains <-chan *DomainRecord, opts ...Option) (*LshEnsemble, error) {
+	return BootstrapLshEnsembleEquiDepthOf(numPart, numHash, maxK, totalNumDomains, sortedDomains, opts...)
+}
+
+// BootstrapLshEnsemblePlusEquiDepthOf builds an index with keys of type K from a channel of domains
+// using equi-depth partitions -- partitions have approximately the same
+// number of domains.
+// The returned index consists of MinHash LSH implemented using LshForestArrayOf.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
+// sortedDomains is a DomainRecord channel emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
+func BootstrapLshEnsemblePlusEquiDepthOf[K comparable](numPart, numHash, maxK,
+	totalNumDomains int, sortedDomains <-chan *DomainRecordOf[K], opts ...Option) (*LshEnsembleOf[K], error) {
+	index := newForestArrayEnsemble[K](make([]Partition, numPart), numHash, maxK,
+		totalNumDomains, opts)
 	err := bootstrapEquiDepth(index, totalNumDomains, sortedDomains)
 	if err != nil {
 		return nil, err
@@ -124,20 +209,15 @@ func BootstrapLshEnsembleEquiDepth(numPart, numHash, maxK, totalNumDomains int,
 // numHash is the number of hash functions in MinHash.
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
 // sortedDomains is a DomainRecord channel emitting domains in sorted order by their sizes.
+// opts are the options to configure the index.
 func BootstrapLshEnsemblePlusEquiDepth(numPart, numHash, maxK,
-	totalNumDomains int, sortedDomains <-chan *DomainRecord) (*LshEnsemble, error) {
-	index := NewLshEnsemblePlus(make([]Partition, numPart), numHash, maxK,
-		totalNumDomains)
-	err := bootstrapEquiDepth(index, totalNumDomains, sortedDomains)
-	if err != nil {
-		return nil, err
-	}
-	return index, nil
+	totalNumDomains int, sortedDomains <-chan *DomainRecord, opts ...Option) (*LshEnsemble, error) {
+	return BootstrapLshEnsemblePlusEquiDepthOf(numPart, numHash, maxK, totalNumDomains, sortedDomains, opts...)
 }
 
-// Recs2Chan is a utility function that converts a DomainRecord slice in memory to a DomainRecord channel.
-func Recs2Chan(recs []*DomainRecord) <-chan *DomainRecord {
-	c := make(chan *DomainRecord, 1000)
+// Recs2ChanOf is a utility function that converts a DomainRecordOf slice in memory to a DomainRecordOf channel.
+func Recs2ChanOf[K comparable](recs []*DomainRecordOf[K]) <-chan *DomainRecordOf[K] {
+	c := make(chan *DomainRecordOf[K], 1000)
 	go func() {
 		for _, r := range recs {
 			c <- r
@@ -146,3 +226,141 @@ func Recs2Chan(recs []*DomainRecord) <-chan *DomainRecord {
 	}()
 	return c
 }
+
+// Recs2Chan is a utility function that converts a DomainRecord slice in memory to a DomainRecord channel.
+func Recs2Chan(recs []*DomainRecord) <-chan *DomainRecord {
+	return Recs2ChanOf(recs)
+}
+
+// bootstrapUnsorted builds an index from domains in any order.
+// The domains are written to a temporary file while their size distribution
+// is computed, then added to the index created by newIndex given the
+// partitions and the initial size of hash tables.
+func bootstrapUnsorted[K comparable](numPart int, domains <-chan *DomainRecordOf[K], opts []Option,
+	newIndex func(parts []Partition, initSize int) *LshEnsembleOf[K]) (*LshEnsembleOf[K], error) {
+	spill, err := os.CreateTemp("", "lshensemble-bootstrap-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spill.Name())
+	defer spill.Close()
+	w := bufio.NewWriter(spill)
+	enc := gob.NewEncoder(w)
+	sizeCounts := make(map[int]int)
+	var numDomains int
+	for rec := range domains {
+		if err := enc.Encode(rec); err != nil {
+			// Drain the channel so the sender is not blocked.
+			for range domains {
+			}
+			return nil, err
+		}
+		sizeCounts[rec.Size]++
+		numDomains++
+	}
+	if numDomains == 0 {
+		return nil, errNoDomainRecords
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	sizes, counts := sortSizeCounts(sizeCounts)
+	partitions := partitionSizes(sizes, counts, numPart, opts)
+	index := newIndex(partitions, numDomains/len(partitions))
+	if _, err := spill.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	dec := gob.NewDecoder(bufio.NewReader(spill))
+	for i := 0; i < numDomains; i++ {
+		var rec DomainRecordOf[K]
+		if err := dec.Decode(&rec); err != nil {
+			return nil, err
+		}
+		partInd, found := index.partitionIndex(rec.Size)
+		if !found {
+			return nil, errNoMatchingPartition
+		}
+		index.add(rec.Key, rec.Signature, rec.Size, partInd)
+	}
+	index.Index()
+	index.wrapConcurrentInserts()
+	return index, nil
+}
+
+// BootstrapLshEnsembleOptimalUnsortedOf builds an index with keys of type K
+// from a channel of domains in any order using optimal partitioning.
+// The channel is read only once, and the domains are written to a
+// temporary file in the default directory for temporary files (see
+// os.TempDir) until the partitions are computed.
+// The domains are encoded using encoding/gob, so if K is an interface
+// type, keys that are not of a built-in type must be registered using
+// gob.Register.
+// The returned index consists of MinHash LSH implemented using LshForestOf.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash
+// functions per "band".
+// opts are the options to configure the index.
+func BootstrapLshEnsembleOptimalUnsortedOf[K comparable](numPart, numHash, maxK int,
+	domains <-chan *DomainRecordOf[K], opts ...Option) (*LshEnsembleOf[K], error) {
+	return bootstrapUnsorted(numPart, domains, opts, func(parts []Partition, initSize int) *LshEnsembleOf[K] {
+		return newForestEnsemble[K](parts, numHash, maxK, initSize, opts)
+	})
+}
+
+// BootstrapLshEnsembleOptimalUnsorted builds an index from a channel of
+// domains in any order using optimal partitioning.
+// The channel is read only once, and the domains are written to a
+// temporary file in the default directory for temporary files (see
+// os.TempDir) until the partitions are computed.
+// The domains are encoded using encoding/gob, so keys that are not of a
+// built-in type must be registered using gob.Register.
+// The returned index consists of MinHash LSH implemented using LshForest.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash
+// functions per "band".
+// opts are the options to configure the index.
+func BootstrapLshEnsembleOptimalUnsorted(numPart, numHash, maxK int,
+	domains <-chan *DomainRecord, opts ...Option) (*LshEnsemble, error) {
+	return BootstrapLshEnsembleOptimalUnsortedOf(numPart, numHash, maxK, domains, opts...)
+}
+
+// BootstrapLshEnsemblePlusOptimalUnsortedOf builds an index with keys of
+// type K from a channel of domains in any order using optimal partitioning.
+// The channel is read only once, and the domains are written to a
+// temporary file in the default directory for temporary files (see
+// os.TempDir) until the partitions are computed.
+// The domains are encoded using encoding/gob, so if K is an interface
+// type, keys that are not of a built-in type must be registered using
+// gob.Register.
+// The returned index consists of MinHash LSH implemented using LshForestArrayOf.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash
+// functions per "band".
+// opts are the options to configure the index.
+func BootstrapLshEnsemblePlusOptimalUnsortedOf[K comparable](numPart, numHash, maxK int,
+	domains <-chan *DomainRecordOf[K], opts ...Option) (*LshEnsembleOf[K], error) {
+	return bootstrapUnsorted(numPart, domains, opts, func(parts []Partition, initSize int) *LshEnsembleOf[K] {
+		return newForestArrayEnsemble[K](parts, numHash, maxK, initSize, opts)
+	})
+}
+
+// BootstrapLshEnsemblePlusOptimalUnsorted builds an index from a channel of
+// domains in any order using optimal partitioning.
+// The channel is read only once, and the domains are written to a
+// temporary file in the default directory for temporary files (see
+// os.TempDir) until the partitions are computed.
+// The domains are encoded using encoding/gob, so keys that are not of a
+// built-in type must be registered using gob.Register.
+// The returned index consists of MinHash LSH implemented using LshForestArray.
+// numPart is the number of partitions to create.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash
+// functions per "band".
+// opts are the options to configure the index.
+func BootstrapLshEnsemblePlusOptimalUnsorted(numPart, numHash, maxK int,
+	domains <-chan *DomainRecord, opts ...Option) (*LshEnsemble, error) {
+	return BootstrapLshEnsemblePlusOptimalUnsortedOf(numPart, numHash, maxK, domains, opts...)
+}
@@ -0,0 +1,101 @@
+package lshensemble
+
+import (
+	"encoding/gob"
+	"testing"
+)
+
+func Test_BootstrapLshEnsembleOptimalUnsorted(t *testing.T) {
+	recs := testDomainRecords(128)
+	sorted, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reverse the records so they are in descending order of size.
+	unsortedRecs := make([]*DomainRecord, len(recs))
+	for i := range recs {
+		unsortedRecs[len(recs)-1-i] = recs[i]
+	}
+	for _, bootstrap := range []func(int, int, int, <-chan *DomainRecord, ...Option) (*LshEnsemble, error){
+		BootstrapLshEnsembleOptimalUnsorted,
+		BootstrapLshEnsemblePlusOptimalUnsorted,
+	} {
+		index, err := bootstrap(2, 128, 4, Recs2Chan(unsortedRecs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Partitions) != len(sorted.Partitions) {
+			t.Fatalf("Expected %d partitions, got %d",
+				len(sorted.Partitions), len(index.Partitions))
+		}
+		for i := range index.Partitions {
+			if index.Partitions[i] != sorted.Partitions[i] {
+				t.Errorf("Partition %d: expected %v, got %v",
+					i, sorted.Partitions[i], index.Partitions[i])
+			}
+		}
+		expected := queryAll(sorted, recs, 0.9)
+		results := queryAll(index, recs, 0.9)
+		for i := range recs {
+			if !sameKeys(expected[i], results[i]) {
+				t.Errorf("Query %v: expected %v, got %v", recs[i].Key, expected[i], results[i])
+			}
+		}
+	}
+}
+
+func Test_BootstrapLshEnsembleOptimalUnsortedEmpty(t *testing.T) {
+	if _, err := BootstrapLshEnsembleOptimalUnsorted(2, 128, 4,
+		Recs2Chan([]*DomainRecord{})); err == nil {
+		t.Error("Expected error for empty domain stream")
+	}
+}
+
+type unregisteredKey struct{ Table, Column string }
+
+type registeredKey struct{ Table, Column string }
+
+func Test_BootstrapLshEnsembleOptimalUnsortedCustomKeys(t *testing.T) {
+	recs := testDomainRecords(128)
+	withKeys := func(key func(i int) interface{}) []*DomainRecord {
+		keyed := make([]*DomainRecord, len(recs))
+		for i, rec := range recs {
+			keyed[i] = &DomainRecord{Key: key(i), Size: rec.Size, Signature: rec.Signature}
+		}
+		return keyed
+	}
+	// Keys of custom types in interface{} keys must be registered.
+	unregistered := withKeys(func(i int) interface{} { return unregisteredKey{"t", recs[i].Key.(string)} })
+	if _, err := BootstrapLshEnsembleOptimalUnsorted(2, 128, 4, Recs2Chan(unregistered)); err == nil {
+		t.Fatal("expecting error for unregistered key type")
+	}
+	gob.Register(registeredKey{})
+	registered := withKeys(func(i int) interface{} { return registeredKey{"t", recs[i].Key.(string)} })
+	index, err := BootstrapLshEnsembleOptimalUnsorted(2, 128, 4, Recs2Chan(registered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range registered {
+		result, _ := index.QueryTimed(rec.Signature, rec.Size, 0.9)
+		var found bool
+		for _, key := range result {
+			if key == rec.Key {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("unable to retrieve inserted key", rec.Key)
+		}
+	}
+
+	// Keys of a concrete custom type need no registration.
+	typed := make(chan *DomainRecordOf[unregisteredKey], len(recs))
+	for _, rec := range recs {
+		typed <- &DomainRecordOf[unregisteredKey]{Key: unregisteredKey{"t", rec.Key.(string)}, Size: rec.Size, Signature: rec.Signature}
+	}
+	close(typed)
+	if _, err := BootstrapLshEnsembleOptimalUnsortedOf(2, 128, 4, typed); err != nil {
+		t.Fatal(err)
+	}
+}
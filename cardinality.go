@@ -0,0 +1,124 @@
+package lshensemble
+
+import (
+	"errors"
+	"math"
+)
+
+var errMinhashOptions = errors.New("Minhash object must be created with the hash family and permutation scheme of the index")
+
+// Cardinality returns the estimated number of distinct values pushed to
+// the MinHash object, which can be used as the domain size.
+// The estimate is computed from the minimum hash values in the signature
+// (http://www.cohenwang.com/edith/Papers/tcest.pdf), and its relative
+// error decreases with the number of hash functions.
+// For a weighted MinHash object, it is the number of values pushed.
+func (m *Minhash) Cardinality() int {
+	switch sk := m.sk.(type) {
+	case *minWise:
+		return sk.cardinality()
+	case *universalMinWise:
+		return sk.cardinality()
+	case *onePermutation:
+		return sk.cardinality()
+	case *weightedMinWise:
+		return sk.numValues
+	}
+	return 0
+}
+
+// cardinality estimates the number of distinct values, modeling the
+// hash values in each bin as a Poisson process with rate n/numHash, whose
+// maximum likelihood estimate is the number of non-empty bins divided by
+// the total length of the bins up to their minimum hash values.
+func (o *onePermutation) cardinality() int {
+	k := float64(len(o.bins))
+	var numFilled int
+	var length float64
+	for i, filled := range o.filled {
+		if !filled {
+			length += 1.0
+			continue
+		}
+		numFilled++
+		// The position of the minimum hash value in its bin, in [0, 1).
+		u := float64(o.bins[i])/math.Exp2(64)*k - float64(i)
+		length += math.Min(math.Max(u, 0.0), 1.0)
+	}
+	if numFilled == 0 {
+		return 0
+	}
+	return int(math.Round(k * float64(numFilled) / length))
+}
+
+// domainSize returns the size used to index and query the signature of
+// the MinHash object, which is its estimated cardinality, or its total
+// weight if it is weighted, as the size of a weighted domain must be
+// comparable with the total weights of the queries.
+func (m *Minhash) domainSize() int {
+	if w, ok := m.sk.(*weightedMinWise); ok {
+		return weightSize(w.totalWeight)
+	}
+	return m.Cardinality()
+}
+
+// NewDomainRecordOf creates a domain record with a key of type K, the
+// signature of the MinHash object, and its estimated cardinality as the
+// domain size. The total weight of a weighted MinHash object is used as
+// the domain size, as in NewWeightedDomainRecordOf.
+func NewDomainRecordOf[K comparable](key K, mh *Minhash) *DomainRecordOf[K] {
+	return &DomainRecordOf[K]{
+		Key:       key,
+		Size:      mh.domainSize(),
+		Signature: mh.Signature(),
+	}
+}
+
+// NewDomainRecord creates a domain record with the signature of the
+// MinHash object, and its estimated cardinality as the domain size.
+// The total weight of a weighted MinHash object is used as the domain
+// size, as in NewWeightedDomainRecord.
+func NewDomainRecord(key interface{}, mh *Minhash) *DomainRecord {
+	return NewDomainRecordOf(key, mh)
+}
+
+// PrepareMinhash adds a new domain to the index given its MinHash object,
+// using its estimated cardinality as the domain size, or its total weight
+// if it is weighted, as in PrepareWeighted.
+// See Prepare for details.
+// An error is returned if mh is not created with the hash family and
+// permutation scheme recorded by WithMinhashOptions.
+func (e *LshEnsembleOf[K]) PrepareMinhash(key K, mh *Minhash) error {
+	if !e.matchMinhash(mh) {
+		return errMinhashOptions
+	}
+	return e.Prepare(key, mh.Signature(), mh.domainSize())
+}
+
+// QueryMinhash is similar to Query, but given the MinHash object of the
+// query domain, using its estimated cardinality as the domain size, or its
+// total weight if it is weighted, as in QueryWeighted.
+// It panics if mh is not created with the hash family and permutation
+// scheme recorded by WithMinhashOptions.
+func (e *LshEnsembleOf[K]) QueryMinhash(mh *Minhash, threshold float64, done <-chan struct{}) <-chan K {
+	if !e.matchMinhash(mh) {
+		panic(errMinhashOptions)
+	}
+	return e.Query(mh.Signature(), mh.domainSize(), threshold, done)
+}
+
+// matchMinhash returns true if mh is created with the hash family and
+// permutation scheme of the index. The scheme does not apply to one
+// permutation and weighted MinHash objects.
+func (e *LshEnsembleOf[K]) matchMinhash(mh *Minhash) bool {
+	if mh.family != e.minhash.family {
+		return false
+	}
+	switch mh.kind {
+	case sketchMinWise:
+		return e.minhash.scheme == LinearPermutations
+	case sketchUniversal:
+		return e.minhash.scheme == UniversalPermutations
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package lshensemble
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func Test_MinhashCardinality(t *testing.T) {
+	for _, newMinhash := range []func(int64, int, ...MinhashOption) *Minhash{NewMinhash, NewOnePermutationMinhash} {
+		if c := newMinhash(1, 256).Cardinality(); c != 0 {
+			t.Errorf("Expected cardinality 0 of empty Minhash, got %d", c)
+		}
+		for _, n := range []int{50, 1000, 100000} {
+			mh := newMinhash(1, 256)
+			d := data(n)
+			hashing(mh, 0, n, d)
+			// Duplicate values do not change the cardinality.
+			hashing(mh, 0, n/2, d)
+			c := mh.Cardinality()
+			if relErr := math.Abs(float64(c-n)) / float64(n); relErr > 0.2 {
+				t.Errorf("Expected cardinality close to %d, got %d", n, c)
+			}
+		}
+	}
+}
+
+func Test_LshEnsembleQueryMinhash(t *testing.T) {
+	d := data(2000)
+	index := NewLshEnsemble([]Partition{{1, 1000}, {1001, 10000}}, 128, 4, 2)
+	mhs := make([]*Minhash, 2)
+	for i := range mhs {
+		mhs[i] = NewMinhash(1, 128)
+		hashing(mhs[i], 0, 500*(i+1), d)
+		if err := index.PrepareMinhash(i, mhs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Index()
+	done := make(chan struct{})
+	defer close(done)
+	var found bool
+	for key := range index.QueryMinhash(mhs[0], 0.9, done) {
+		if key == 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Unable to retrieve key using the Minhash")
+	}
+	// MinHash objects of other options are rejected.
+	for _, mh := range []*Minhash{
+		NewMinhash(1, 128, WithHashFamily(XXHash64)),
+		NewMinhash(1, 128, WithPermutationScheme(UniversalPermutations)),
+	} {
+		if err := index.PrepareMinhash(2, mh); err != errMinhashOptions {
+			t.Errorf("Expected error adding Minhash of other options, got %v", err)
+		}
+	}
+	rec := NewDomainRecord("a", mhs[1])
+	if rec.Key != "a" || rec.Size != mhs[1].Cardinality() || !sameSignature(rec.Signature, mhs[1].Signature()) {
+		t.Errorf("Incorrect domain record %v", rec)
+	}
+}
+
+func Test_LshEnsembleMinhashOptions(t *testing.T) {
+	index := NewLshEnsemble([]Partition{{1, 10000}}, 128, 4, 2,
+		WithMinhashOptions(WithHashFamily(XXHash64), WithPermutationScheme(UniversalPermutations)))
+	mh := NewMinhash(1, 128, WithHashFamily(XXHash64), WithPermutationScheme(UniversalPermutations))
+	hashing(mh, 0, 100, data(100))
+	if err := index.PrepareMinhash("a", mh); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.PrepareMinhash("b", NewMinhash(1, 128)); err != errMinhashOptions {
+		t.Errorf("Expected error adding Minhash of default options, got %v", err)
+	}
+	// The options are kept by WriteTo and ReadFrom.
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Index()
+	var found bool
+	for key := range loaded.QueryMinhash(mh, 0.9, nil) {
+		found = found || key == "a"
+	}
+	if !found {
+		t.Error("Unable to retrieve key using the Minhash on the loaded index")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic querying Minhash of default options")
+		}
+	}()
+	loaded.QueryMinhash(NewMinhash(1, 128), 0.9, nil)
+}
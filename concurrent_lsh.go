@@ -0,0 +1,303 @@
+package lshensemble
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultMergeThreshold is the number of domains in the delta segment
+// that triggers a background merge, if not given by WithConcurrentInserts.
+const defaultMergeThreshold = 1024
+
+// cloneableLsh is implemented by LshForestOf and LshForestArrayOf.
+type cloneableLsh[K comparable] interface {
+	LshOf[K]
+	clone() LshOf[K]
+	cloneEmpty() LshOf[K]
+	numKeys() int
+	hasKey(key K) bool
+}
+
+// deltaRecord is a domain added to the delta segment, seq is the
+// order of the insertion.
+type deltaRecord[K comparable] struct {
+	key K
+	sig []uint64
+	seq uint64
+}
+
+// lshSnapshot is an immutable indexed main segment, and the keys removed
+// since it was created, mapped to the order of the removal.
+type lshSnapshot[K comparable] struct {
+	main    LshOf[K]
+	removed map[K]uint64
+}
+
+// concurrentLsh is an Lsh safe for concurrent Add, Remove and Query.
+// Added keys are indexed in a small delta segment, which is queried along
+// with the main segment and searchable immediately.
+// When the delta segment reaches the merge threshold, a new main segment
+// is built from a copy of the current one in the background, and swapped
+// in atomically once indexed. Indexing the copy only sorts the records of
+// the delta segment and merges them into the sorted hash tables, so a
+// merge takes time linear in the size of the main segment.
+type concurrentLsh[K comparable] struct {
+	// empty is an empty Lsh used to create delta segments.
+	empty          cloneableLsh[K]
+	mergeThreshold int
+	merging        atomic.Bool
+	// mergeMu serializes merges.
+	mergeMu sync.Mutex
+	// mu guards the fields below and the removed keys of the snapshot.
+	mu       sync.RWMutex
+	snapshot *lshSnapshot[K]
+	delta    LshOf[K]
+	records  []deltaRecord[K]
+	seq      uint64
+}
+
+// newConcurrentLsh wraps an indexed Lsh for concurrent inserts, which
+// becomes the main segment.
+func newConcurrentLsh[K comparable](lsh cloneableLsh[K], mergeThreshold int) *concurrentLsh[K] {
+	if mergeThreshold <= 0 {
+		mergeThreshold = defaultMergeThreshold
+	}
+	empty := lsh.cloneEmpty().(cloneableLsh[K])
+	return &concurrentLsh[K]{
+		empty:          empty,
+		mergeThreshold: mergeThreshold,
+		snapshot:       &lshSnapshot[K]{main: lsh, removed: make(map[K]uint64)},
+		delta:          empty.clone(),
+	}
+}
+
+// Add a key with MinHash signature into the delta segment, the key is
+// searchable immediately.
+func (c *concurrentLsh[K]) Add(key K, sig []uint64) {
+	c.mu.Lock()
+	c.seq++
+	// The signature is added to the main segment later by a merge, so
+	// a copy is kept in case the caller reuses it.
+	sig = append([]uint64(nil), sig...)
+	c.records = append(c.records, deltaRecord[K]{key, sig, c.seq})
+	// Indexing inserts the entries of the key into the sorted delta
+	// segment, without sorting it again.
+	c.delta.Add(key, sig)
+	c.delta.Index()
+	full := len(c.records) >= c.mergeThreshold
+	c.mu.Unlock()
+	if full && c.merging.CompareAndSwap(false, true) {
+		go func() {
+			c.merge()
+			c.merging.Store(false)
+		}()
+	}
+}
+
+// Remove a key from the index, the key is no longer returned by Query.
+func (c *concurrentLsh[K]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.snapshot.removed[key] = c.seq
+	// Records are never modified in place, as they may be read by a merge.
+	records := make([]deltaRecord[K], 0, len(c.records))
+	for _, r := range c.records {
+		if r.key != key {
+			records = append(records, r)
+		}
+	}
+	c.records = records
+	c.delta.Remove(key)
+}
+
+// Index merges the delta segment into the main segment, and waits until
+// the merged main segment is swapped in.
+func (c *concurrentLsh[K]) Index() {
+	c.merge()
+}
+
+// merge builds a new main segment from a copy of the current one, with
+// the removed keys deleted and the records of the delta segment added,
+// and swaps it in.
+func (c *concurrentLsh[K]) merge() {
+	c.mergeMu.Lock()
+	defer c.mergeMu.Unlock()
+	c.mu.RLock()
+	snapshot, records, seq := c.snapshot, c.records, c.seq
+	removed := make([]K, 0, len(snapshot.removed))
+	for key := range snapshot.removed {
+		removed = append(removed, key)
+	}
+	c.mu.RUnlock()
+	if len(records) == 0 && len(removed) == 0 {
+		return
+	}
+	next := c.build(snapshot.main, removed, records)
+	next.Index()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Keep the removals and records made during the merge.
+	nextSnapshot := &lshSnapshot[K]{main: next, removed: make(map[K]uint64)}
+	for key, s := range c.snapshot.removed {
+		if s > seq {
+			nextSnapshot.removed[key] = s
+		}
+	}
+	c.snapshot = nextSnapshot
+	c.delta = c.empty.clone()
+	var remaining []deltaRecord[K]
+	for _, r := range c.records {
+		if r.seq > seq {
+			remaining = append(remaining, r)
+			c.delta.Add(r.key, r.sig)
+		}
+	}
+	c.records = remaining
+	c.delta.Index()
+}
+
+// build returns a copy of main with the removed keys deleted, and the
+// records added but not indexed.
+func (c *concurrentLsh[K]) build(main LshOf[K], removed []K, records []deltaRecord[K]) LshOf[K] {
+	next := main.(cloneableLsh[K]).clone()
+	for _, key := range removed {
+		next.Remove(key)
+	}
+	for _, r := range records {
+		next.Add(r.key, r.sig)
+	}
+	return next
+}
+
+// flatten returns a copy of the index as the wrapped Lsh type, with the
+// records of the delta segment added but not indexed.
+func (c *concurrentLsh[K]) flatten() LshOf[K] {
+	c.mergeMu.Lock()
+	defer c.mergeMu.Unlock()
+	c.mu.RLock()
+	snapshot, records := c.snapshot, c.records
+	removed := make([]K, 0, len(snapshot.removed))
+	for key := range snapshot.removed {
+		removed = append(removed, key)
+	}
+	c.mu.RUnlock()
+	return c.build(snapshot.main, removed, records)
+}
+
+func (c *concurrentLsh[K]) isRemoved(snapshot *lshSnapshot[K], key K) bool {
+	c.mu.RLock()
+	_, removed := snapshot.removed[key]
+	c.mu.RUnlock()
+	return removed
+}
+
+// Query returns candidate keys given the query signature and parameters,
+// from both the delta and the main segments.
+func (c *concurrentLsh[K]) Query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) {
+	c.query(sig, k, l, out, done)
+}
+
+// query is the same as Query, and returns true if it is stopped by
+// closing done.
+func (c *concurrentLsh[K]) query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) bool {
+	// Collect the candidates from the small delta segment while holding
+	// the lock, so writers are not blocked by slow consumers.
+	c.mu.RLock()
+	snapshot := c.snapshot
+	deltaOut := make(chan K)
+	go func() {
+		c.delta.Query(sig, k, l, deltaOut, done)
+		close(deltaOut)
+	}()
+	seens := make(map[K]bool)
+	for key := range deltaOut {
+		seens[key] = true
+	}
+	c.mu.RUnlock()
+	for key := range seens {
+		select {
+		case out <- key:
+		case <-done:
+			return true
+		}
+	}
+	// The delta segment may have been queried partially.
+	select {
+	case <-done:
+		return true
+	default:
+	}
+	mainOut := make(chan K)
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		for range mainOut {
+		}
+	}()
+	go func() {
+		snapshot.main.Query(sig, k, l, mainOut, stop)
+		close(mainOut)
+	}()
+	for key := range mainOut {
+		if seens[key] || c.isRemoved(snapshot, key) {
+			continue
+		}
+		select {
+		case out <- key:
+		case <-done:
+			return true
+		}
+	}
+	return false
+}
+
+// numKeys returns the number of searchable keys in the main and the
+// delta segments.
+func (c *concurrentLsh[K]) numKeys() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	main := c.snapshot.main.(cloneableLsh[K])
+	n := main.numKeys() + c.delta.(cloneableLsh[K]).numKeys()
+	for key := range c.snapshot.removed {
+		if main.hasKey(key) {
+			n--
+		}
+	}
+	return n
+}
+
+// QueryContext returns candidate keys given the query signature and parameters,
+// and stops when ctx is done, returning the context error.
+func (c *concurrentLsh[K]) QueryContext(ctx context.Context, sig []uint64, k, l int, out chan<- K) error {
+	if c.query(sig, k, l, out, ctx.Done()) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// OptimalKL returns the optimal K and L for containment search,
+// and the false positive and negative probabilities.
+func (c *concurrentLsh[K]) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return c.empty.OptimalKL(x, q, t)
+}
+
+// OptimalKLJaccard returns the optimal K and L for Jaccard similarity
+// search, and the false positive and negative probabilities.
+func (c *concurrentLsh[K]) OptimalKLJaccard(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return c.empty.OptimalKLJaccard(x, q, t)
+}
+
+// optimalKL returns the optimal K and L under the objective for
+// the similarity measure m, integrating the probabilities with the
+// absolute error tolerance.
+func (c *concurrentLsh[K]) optimalKL(m measure, x, q int, t float64, obj Objective, tolerance float64) (optK, optL int, fp, fn float64) {
+	return c.empty.(objectiveLsh).optimalKL(m, x, q, t, obj, tolerance)
+}
+
+// validKL returns true if queries of the parameters K and L are
+// supported by the segments.
+func (c *concurrentLsh[K]) validKL(k, l int) bool {
+	return c.empty.(klValidator).validKL(k, l)
+}
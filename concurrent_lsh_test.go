@@ -0,0 +1,179 @@
+package lshensemble
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_LshEnsembleConcurrentInserts(t *testing.T) {
+	recs := testDomainRecords(128)
+	parts := []Partition{{4, 5}, {6, 7}}
+	for _, index := range []*LshEnsemble{
+		NewLshEnsemble(parts, 128, 4, 4, WithConcurrentInserts(2)),
+		NewLshEnsemblePlus(parts, 128, 4, 4, WithConcurrentInserts(2)),
+	} {
+		// Added domains are searchable without calling Index.
+		for _, rec := range recs {
+			if err := index.Prepare(rec.Key, rec.Signature, rec.Size); err != nil {
+				t.Fatal(err)
+			}
+			results, _ := index.QueryTimed(rec.Signature, rec.Size, 1.0)
+			if !sameKeys(results, []interface{}{rec.Key}) {
+				t.Errorf("Query %v after Prepare: got %v", rec.Key, results)
+			}
+		}
+		index.Index()
+		for _, rec := range recs {
+			results, _ := index.QueryTimed(rec.Signature, rec.Size, 1.0)
+			if !sameKeys(results, []interface{}{rec.Key}) {
+				t.Errorf("Query %v after Index: got %v", rec.Key, results)
+			}
+		}
+		// Removed domains are excluded before and after merging.
+		index.Remove(recs[0].Key)
+		for i := 0; i < 2; i++ {
+			if results, _ := index.QueryTimed(recs[0].Signature, recs[0].Size, 1.0); len(results) != 0 {
+				t.Errorf("Query removed key: got %v", results)
+			}
+			index.Index()
+		}
+		// Domains added again after removal are found.
+		index.Prepare(recs[0].Key, recs[0].Signature, recs[0].Size)
+		results, _ := index.QueryTimed(recs[0].Signature, recs[0].Size, 1.0)
+		if !sameKeys(results, []interface{}{recs[0].Key}) {
+			t.Errorf("Query %v after adding again: got %v", recs[0].Key, results)
+		}
+		// The delta segments and the option are written as well, so the
+		// loaded index is searchable without calling Index.
+		var buf bytes.Buffer
+		if _, err := index.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var loaded LshEnsemble
+		if _, err := loaded.ReadFrom(&buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, lsh := range loaded.lshes {
+			if c, ok := lsh.(*concurrentLsh[interface{}]); !ok || c.mergeThreshold != 2 {
+				t.Fatalf("Loaded index does not keep concurrent inserts: %T", lsh)
+			}
+		}
+		expected := queryAll(index, recs, 0.9)
+		got := queryAll(&loaded, recs, 0.9)
+		for i := range recs {
+			if !sameKeys(expected[i], got[i]) {
+				t.Errorf("Query %v on loaded index: expected %v, got %v",
+					recs[i].Key, expected[i], got[i])
+			}
+		}
+	}
+}
+
+func Test_LshEnsembleConcurrentInsertsAndQueries(t *testing.T) {
+	numWriters, numPerWriter := 4, 50
+	parts := []Partition{{1, 10}, {11, 20}}
+	index := NewLshEnsembleOf[string](parts, 64, 4, 16, WithConcurrentInserts(16))
+	sigs := make(map[string][]uint64)
+	for w := 0; w < numWriters; w++ {
+		for i := 0; i < numPerWriter; i++ {
+			key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+			mh := NewMinhash(1, 64)
+			mh.Push([]byte(key))
+			sigs[key] = mh.Signature()
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < numWriters; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numPerWriter; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				index.Prepare(key, sigs[key], 1+i%20)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numPerWriter; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				index.QueryTimed(sigs[key], 1+i%20, 0.5)
+			}
+		}(w)
+	}
+	wg.Wait()
+	index.Index()
+	for key, sig := range sigs {
+		var found bool
+		results, _ := index.QueryTimed(sig, 1, 1.0)
+		for _, result := range results {
+			if result == key {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Unable to retrieve key %s", key)
+		}
+	}
+}
+
+func Test_LshEnsembleConcurrentInsertsReusedSignature(t *testing.T) {
+	recs := testDomainRecords(128)
+	index := NewLshEnsemble([]Partition{{1, 100}}, 128, 4, 4, WithConcurrentInserts(1000))
+	// The delta records keep copies of the signatures, so merging them
+	// into the main segment indexes the signatures given to Prepare.
+	buf := make([]uint64, 128)
+	for _, rec := range recs {
+		copy(buf, rec.Signature)
+		index.Prepare(rec.Key, buf, rec.Size)
+	}
+	index.Index()
+	for _, rec := range recs {
+		results, _ := index.QueryTimed(rec.Signature, rec.Size, 1.0)
+		if !sameKeys(results, []interface{}{rec.Key}) {
+			t.Errorf("Query %v: got %v", rec.Key, results)
+		}
+	}
+}
+
+func Test_LshEnsembleConcurrentInsertsBootstrap(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) }, WithConcurrentInserts(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The forests are wrapped after bootstrapping.
+	for _, lsh := range index.lshes {
+		if _, ok := lsh.(*concurrentLsh[interface{}]); !ok {
+			t.Fatalf("Bootstrapped index does not keep concurrent inserts: %T", lsh)
+		}
+	}
+	for _, rec := range recs {
+		results, _ := index.QueryTimed(rec.Signature, rec.Size, 1.0)
+		var found bool
+		for _, key := range results {
+			if key == rec.Key {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Unable to retrieve key %v", rec.Key)
+		}
+	}
+
+	// An index without partitions keeps the option as well.
+	var buf bytes.Buffer
+	empty := NewLshEnsemble(nil, 128, 4, 2, WithConcurrentInserts(2))
+	if _, err := empty.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.mergeThreshold != 2 {
+		t.Errorf("Expected merge threshold 2, got %d", loaded.mergeThreshold)
+	}
+}
@@ -4,25 +4,31 @@ import (
 	"sort"
 )
 
-// DomainRecord represents a domain record.
-type DomainRecord struct {
+// DomainRecordOf represents a domain record with a key of type K.
+type DomainRecordOf[K comparable] struct {
 	// The unique key of this domain.
-	Key interface{}
+	Key K
 	// The domain size.
 	Size int
 	// The MinHash signature of this domain.
 	Signature []uint64
 }
 
+// DomainRecord represents a domain record.
+type DomainRecord = DomainRecordOf[interface{}]
+
+// BySizeOf is a wrapper for sorting domains with keys of type K.
+type BySizeOf[K comparable] []*DomainRecordOf[K]
+
 // BySize is a wrapper for sorting domains.
-type BySize []*DomainRecord
+type BySize = BySizeOf[interface{}]
 
-func (rs BySize) Len() int           { return len(rs) }
-func (rs BySize) Less(i, j int) bool { return rs[i].Size < rs[j].Size }
-func (rs BySize) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs BySizeOf[K]) Len() int           { return len(rs) }
+func (rs BySizeOf[K]) Less(i, j int) bool { return rs[i].Size < rs[j].Size }
+func (rs BySizeOf[K]) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
 
 // Subset returns a subset of the domains given the size lower bound and upper bound.
-func (rs BySize) Subset(lower, upper int) []*DomainRecord {
+func (rs BySizeOf[K]) Subset(lower, upper int) []*DomainRecordOf[K] {
 	if !sort.IsSorted(rs) {
 		panic("Must be sorted by domain size first")
 	}
@@ -42,5 +48,5 @@ func (rs BySize) Subset(lower, upper int) []*DomainRecord {
 	if end == len(rs)-1 {
 		end++
 	}
-	return []*DomainRecord(rs[start:end])
+	return []*DomainRecordOf[K](rs[start:end])
 }
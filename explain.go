@@ -0,0 +1,89 @@
+package lshensemble
+
+// keyCounter is implemented by the Lsh types of this package, which
+// keep the number of their searchable keys.
+type keyCounter interface {
+	numKeys() int
+}
+
+// PartitionPlan is the query plan of a partition, with the LSH parameters
+// chosen for the query, their predicted false positive and negative
+// probabilities, and the number of searchable domains in the partition.
+// NumCandidates is the number of candidates emitted by the partition when
+// the plan is executed, and -1 before the execution.
+type PartitionPlan struct {
+	Partition     Partition
+	K             int
+	L             int
+	FalsePositive float64
+	FalseNegative float64
+	// NumKeys is -1 if the Lsh of the partition cannot count its keys.
+	NumKeys       int
+	NumCandidates int
+}
+
+// QueryPlanOf is the plan of a containment query on an index with keys
+// of type K, returned by Explain.
+type QueryPlanOf[K comparable] struct {
+	Size       int
+	Threshold  float64
+	Partitions []PartitionPlan
+	index      *LshEnsembleOf[K]
+	params     []param
+}
+
+// QueryPlan is the plan of a containment query, returned by Explain.
+type QueryPlan = QueryPlanOf[interface{}]
+
+// Explain returns the plan of a containment query given the query domain
+// size and the containment threshold, without executing the query.
+// Execute the plan with the query signature to count the candidates
+// emitted by every partition.
+func (e *LshEnsembleOf[K]) Explain(size int, threshold float64) *QueryPlanOf[K] {
+	params := e.computeParams(size, threshold, containmentMeasure, e.objective)
+	plan := &QueryPlanOf[K]{
+		Size:       size,
+		Threshold:  threshold,
+		Partitions: make([]PartitionPlan, len(e.Partitions)),
+		index:      e,
+		params:     params,
+	}
+	for i, p := range e.Partitions {
+		numKeys := -1
+		if lsh, ok := e.lshes[i].(keyCounter); ok {
+			numKeys = lsh.numKeys()
+		}
+		plan.Partitions[i] = PartitionPlan{
+			Partition:     p,
+			K:             params[i].k,
+			L:             params[i].l,
+			FalsePositive: params[i].fp,
+			FalseNegative: params[i].fn,
+			NumKeys:       numKeys,
+			NumCandidates: -1,
+		}
+	}
+	return plan
+}
+
+// Execute runs the query given the MinHash signature of the query domain,
+// returns the candidate domain keys, and sets the number of candidates
+// emitted by every partition.
+// The plan must not be executed concurrently.
+func (p *QueryPlanOf[K]) Execute(sig []uint64) []K {
+	e := p.index
+	keys := make([]K, 0)
+	for i := range e.lshes {
+		keyChan := make(chan K)
+		go func() {
+			e.lshes[i].Query(sig, p.params[i].k, p.params[i].l, keyChan, nil)
+			close(keyChan)
+		}()
+		n := len(keys)
+		for key := range keyChan {
+			keys = append(keys, key)
+		}
+		p.Partitions[i].NumCandidates = len(keys) - n
+	}
+	return keys
+}
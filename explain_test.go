@@ -0,0 +1,74 @@
+package lshensemble
+
+import (
+	"testing"
+)
+
+func Test_LshEnsembleExplain(t *testing.T) {
+	recs := testDomainRecords(128)
+	builders := map[string]func() (*LshEnsemble, error){
+		"LshForest": func() (*LshEnsemble, error) {
+			return BootstrapLshEnsembleOptimal(2, 128, 4,
+				func() <-chan *DomainRecord { return Recs2Chan(recs) })
+		},
+		"LshForestArray": func() (*LshEnsemble, error) {
+			return BootstrapLshEnsemblePlusOptimal(2, 128, 4,
+				func() <-chan *DomainRecord { return Recs2Chan(recs) })
+		},
+		"ConcurrentInserts": func() (*LshEnsemble, error) {
+			return BootstrapLshEnsembleOptimal(2, 128, 4,
+				func() <-chan *DomainRecord { return Recs2Chan(recs) }, WithConcurrentInserts(2))
+		},
+	}
+	for name, build := range builders {
+		index, err := build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Remove(recs[0].Key)
+		rec := recs[1]
+		plan := index.Explain(rec.Size, 0.5)
+		if len(plan.Partitions) != len(index.Partitions) {
+			t.Fatalf("%s: expected %d partition plans, got %d",
+				name, len(index.Partitions), len(plan.Partitions))
+		}
+		var numKeys int
+		for i, p := range plan.Partitions {
+			k, l, fp, fn := index.lshes[i].OptimalKL(p.Partition.Upper, rec.Size, 0.5)
+			if p.K != k || p.L != l || p.FalsePositive != fp || p.FalseNegative != fn {
+				t.Errorf("%s: partition %d plan %+v does not match OptimalKL", name, i, p)
+			}
+			if p.NumCandidates != -1 {
+				t.Errorf("%s: candidates counted before execution", name)
+			}
+			numKeys += p.NumKeys
+		}
+		if numKeys != len(recs)-1 {
+			t.Errorf("%s: expected %d keys, got %d", name, len(recs)-1, numKeys)
+		}
+		keys := plan.Execute(rec.Signature)
+		expected, _ := index.QueryTimed(rec.Signature, rec.Size, 0.5)
+		if !sameKeys(expected, keys) {
+			t.Fatalf("%s: query results mismatch %v, %v", name, expected, keys)
+		}
+		var numCandidates int
+		for _, p := range plan.Partitions {
+			numCandidates += p.NumCandidates
+		}
+		if numCandidates != len(keys) {
+			t.Errorf("%s: expected %d candidates, got %d", name, len(keys), numCandidates)
+		}
+		// The number of keys follows the domains added again.
+		if err := index.Prepare(recs[0].Key, recs[0].Signature, recs[0].Size); err != nil {
+			t.Fatal(err)
+		}
+		index.Index()
+		numKeys = 0
+		for _, p := range index.Explain(rec.Size, 0.5).Partitions {
+			numKeys += p.NumKeys
+		}
+		if numKeys != len(recs) {
+			t.Errorf("%s: expected %d keys after adding again, got %d", name, len(recs), numKeys)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/ekzhu/lshensemble
+
+go 1.20
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/dchest/siphash v1.2.3
+	github.com/orcaman/concurrent-map v1.0.0
+	github.com/spaolacci/murmur3 v1.1.0
+)
@@ -0,0 +1,241 @@
+package lshensemble
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dchest/siphash"
+	"github.com/spaolacci/murmur3"
+)
+
+// HashFamily is the family of the seeded base hash functions used by Minhash.
+type HashFamily byte
+
+const (
+	// FNV64a is the 64-bit FNV-1a hash with the seed as a prefix of every
+	// value, which is the default.
+	FNV64a HashFamily = iota
+	// XXHash64 is the 64-bit xxHash.
+	XXHash64
+	// Murmur3 is the 64-bit variant of MurmurHash3.
+	Murmur3
+	// SipHash is SipHash-2-4 keyed by the seed.
+	SipHash
+)
+
+// PermutationScheme is the scheme for deriving the numHash hash functions,
+// which simulate random permutations, from the base hash functions.
+type PermutationScheme byte
+
+const (
+	// LinearPermutations computes the i-th hash value of a value as
+	// h1 + i * h2, using two base hash functions h1 and h2, which is
+	// the default.
+	LinearPermutations PermutationScheme = iota
+	// UniversalPermutations computes the i-th hash value of a value as
+	// (a_i * h + b_i) mod (2^61 - 1), using a base hash function h and
+	// random coefficients a_i and b_i.
+	UniversalPermutations
+)
+
+// minhashConfig holds the settings given by Minhash options.
+type minhashConfig struct {
+	family HashFamily
+	scheme PermutationScheme
+}
+
+// MinhashOption configures a Minhash when it is created.
+type MinhashOption func(*minhashConfig)
+
+// WithHashFamily makes the Minhash use the family of base hash functions.
+func WithHashFamily(family HashFamily) MinhashOption {
+	return func(c *minhashConfig) {
+		c.family = family
+	}
+}
+
+// WithPermutationScheme makes the Minhash use the scheme for deriving its
+// hash functions. It does not apply to NewOnePermutationMinhash and
+// NewWeightedMinhash, which panic if given a scheme other than
+// LinearPermutations.
+func WithPermutationScheme(scheme PermutationScheme) MinhashOption {
+	return func(c *minhashConfig) {
+		c.scheme = scheme
+	}
+}
+
+func newMinhashConfig(opts []MinhashOption) minhashConfig {
+	var c minhashConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// hashFunc returns a base hash function of the family with the seed.
+// The returned function is not safe for concurrent use.
+func (family HashFamily) hashFunc(seed uint64) func([]byte) uint64 {
+	switch family {
+	case XXHash64:
+		d := xxhash.NewWithSeed(seed)
+		return func(b []byte) uint64 {
+			d.ResetWithSeed(seed)
+			d.Write(b)
+			return d.Sum64()
+		}
+	case Murmur3:
+		// MurmurHash3 takes a 32-bit seed, so both halves of the seed
+		// are folded into it.
+		seed32 := uint32(seed ^ seed>>32)
+		return func(b []byte) uint64 {
+			return murmur3.Sum64WithSeed(b, seed32)
+		}
+	case SipHash:
+		k1 := splitmix64(seed)
+		return func(b []byte) uint64 {
+			return siphash.Hash(seed, k1, b)
+		}
+	}
+	prefix := make([]byte, HashValueSize)
+	binary.BigEndian.PutUint64(prefix, seed)
+	h := fnv.New64a()
+	return func(b []byte) uint64 {
+		h.Reset()
+		h.Write(prefix)
+		h.Write(b)
+		return h.Sum64()
+	}
+}
+
+// seededHashes returns two independent 64-bit hash functions of the
+// family using seeds drawn from r.
+func seededHashes(r *rand.Rand, family HashFamily) (h1, h2 func([]byte) uint64) {
+	seed1 := uint64(r.Int63())
+	seed2 := uint64(r.Int63())
+	return family.hashFunc(seed1), family.hashFunc(seed2)
+}
+
+// minWise is a MinHash sketch using the hash functions h1 + i*h2, which
+// produces the same signatures as github.com/dgryski/go-minhash.
+type minWise struct {
+	h1, h2   func([]byte) uint64
+	minimums []uint64
+}
+
+func newMinWise(h1, h2 func([]byte) uint64, numHash int) *minWise {
+	minimums := make([]uint64, numHash)
+	for i := range minimums {
+		minimums[i] = maxHashValue
+	}
+	return &minWise{h1: h1, h2: h2, minimums: minimums}
+}
+
+func (m *minWise) Push(b []byte) {
+	v1, v2 := m.h1(b), m.h2(b)
+	for i, v := range m.minimums {
+		if hv := v1 + uint64(i)*v2; hv < v {
+			m.minimums[i] = hv
+		}
+	}
+}
+
+func (m *minWise) Signature() []uint64 {
+	return m.minimums
+}
+
+func (m *minWise) merge(other *minWise) {
+	for i, v := range other.minimums {
+		if v < m.minimums[i] {
+			m.minimums[i] = v
+		}
+	}
+}
+
+// cardinality estimates the number of distinct values from the minimum
+// hash values, which are uniform in [0, 2^64).
+func (m *minWise) cardinality() int {
+	var sum float64
+	for _, v := range m.minimums {
+		if v == maxHashValue {
+			return 0
+		}
+		sum += -math.Log(float64(maxHashValue-v) / float64(maxHashValue))
+	}
+	return int(float64(len(m.minimums)-1) / sum)
+}
+
+// mersennePrime is 2^61 - 1, the modulus of the universal permutations.
+const mersennePrime = 1<<61 - 1
+
+// universalMinWise is a MinHash sketch using the universal permutations.
+type universalMinWise struct {
+	hash     func([]byte) uint64
+	a, b     []uint64
+	minimums []uint64
+}
+
+func newUniversalMinWise(r *rand.Rand, family HashFamily, numHash int) *universalMinWise {
+	h1, _ := seededHashes(r, family)
+	u := &universalMinWise{
+		hash:     h1,
+		a:        make([]uint64, numHash),
+		b:        make([]uint64, numHash),
+		minimums: make([]uint64, numHash),
+	}
+	for i := range u.minimums {
+		u.a[i] = 1 + uint64(r.Int63n(mersennePrime-1))
+		u.b[i] = uint64(r.Int63n(mersennePrime))
+		u.minimums[i] = maxHashValue
+	}
+	return u
+}
+
+// mulAddMod returns (a * x + b) mod (2^61 - 1) for a, x and b less
+// than 2^61 - 1.
+func mulAddMod(a, x, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, x)
+	// 2^64 = 2^3 * 2^61, which is congruent to 2^3.
+	v := (hi << 3) + (lo >> 61) + (lo & mersennePrime) + b
+	for v >= mersennePrime {
+		v -= mersennePrime
+	}
+	return v
+}
+
+func (u *universalMinWise) Push(b []byte) {
+	h := u.hash(b) % mersennePrime
+	for i, v := range u.minimums {
+		if hv := mulAddMod(u.a[i], h, u.b[i]); hv < v {
+			u.minimums[i] = hv
+		}
+	}
+}
+
+func (u *universalMinWise) Signature() []uint64 {
+	return u.minimums
+}
+
+func (u *universalMinWise) merge(other *universalMinWise) {
+	for i, v := range other.minimums {
+		if v < u.minimums[i] {
+			u.minimums[i] = v
+		}
+	}
+}
+
+// cardinality estimates the number of distinct values from the minimum
+// hash values, which are uniform in [0, 2^61 - 1).
+func (u *universalMinWise) cardinality() int {
+	var sum float64
+	for _, v := range u.minimums {
+		if v == maxHashValue {
+			return 0
+		}
+		sum += -math.Log(1.0 - float64(v)/mersennePrime)
+	}
+	return int(float64(len(u.minimums)-1) / sum)
+}
@@ -0,0 +1,113 @@
+package lshensemble
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMinhashHashFamilies(t *testing.T) {
+	d := data(10000)
+	act := 3000.0 / 10000.0
+	for _, family := range []HashFamily{FNV64a, XXHash64, Murmur3, SipHash} {
+		for _, scheme := range []PermutationScheme{LinearPermutations, UniversalPermutations} {
+			m1 := NewMinhash(1, 256, WithHashFamily(family), WithPermutationScheme(scheme))
+			m2 := NewMinhash(1, 256, WithHashFamily(family), WithPermutationScheme(scheme))
+			hashing(m1, 0, 6500, d)
+			hashing(m2, 3500, 10000, d)
+			if est := similarity(m1.Signature(), m2.Signature()); math.Abs(est-act) > 0.1 {
+				t.Errorf("Family %d, scheme %d: expected similarity close to %f, got %f",
+					family, scheme, act, est)
+			}
+			if c := m1.Cardinality(); math.Abs(float64(c-6500))/6500 > 0.2 {
+				t.Errorf("Family %d, scheme %d: expected cardinality close to 6500, got %d",
+					family, scheme, c)
+			}
+			// Merged and restored sketches are identical to the original.
+			m3 := NewMinhash(1, 256, WithHashFamily(family), WithPermutationScheme(scheme))
+			hashing(m3, 0, 3500, d)
+			if err := m3.Merge(m2); err != nil {
+				t.Fatal(err)
+			}
+			data, _ := m3.MarshalBinary()
+			var restored Minhash
+			if err := restored.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			all := NewMinhash(1, 256, WithHashFamily(family), WithPermutationScheme(scheme))
+			hashing(all, 0, 10000, d)
+			if !sameSignature(restored.Signature(), all.Signature()) || !restored.Compatible(all) {
+				t.Errorf("Family %d, scheme %d: restored merged Minhash is different", family, scheme)
+			}
+		}
+		o := NewOnePermutationMinhash(1, 256, WithHashFamily(family))
+		hashing(o, 0, 6500, d)
+		if c := o.Cardinality(); math.Abs(float64(c-6500))/6500 > 0.2 {
+			t.Errorf("Family %d: expected one permutation cardinality close to 6500, got %d", family, c)
+		}
+	}
+}
+
+func TestMinhashIncompatibleFamilies(t *testing.T) {
+	m1 := NewMinhash(1, 64)
+	for _, m2 := range []*Minhash{
+		NewMinhash(1, 64, WithHashFamily(XXHash64)),
+		NewMinhash(1, 64, WithPermutationScheme(UniversalPermutations)),
+		NewOnePermutationMinhash(1, 64),
+	} {
+		if m1.Compatible(m2) {
+			t.Error("Minhash objects of different families or schemes are compatible")
+		}
+		if err := m1.Merge(m2); err == nil {
+			t.Error("Expected error merging Minhash objects of different families or schemes")
+		}
+	}
+	if !m1.Compatible(NewMinhash(1, 64, WithHashFamily(FNV64a))) {
+		t.Error("Minhash objects of the same family and scheme are not compatible")
+	}
+}
+
+func TestMinhashUnmarshalVersion1(t *testing.T) {
+	m := NewMinhash(3, 16)
+	m.Push([]byte("a"))
+	data, _ := m.MarshalBinary()
+	// Version 1 has no hash family after the sketch kind.
+	v1 := append([]byte{1, data[1]}, data[3:]...)
+	var restored Minhash
+	if err := restored.UnmarshalBinary(v1); err != nil {
+		t.Fatal(err)
+	}
+	if !sameSignature(restored.Signature(), m.Signature()) || !restored.Compatible(m) {
+		t.Error("Minhash restored from version 1 data is different")
+	}
+}
+
+func TestMinhashSchemeUnsupported(t *testing.T) {
+	for _, newMinhash := range []func(int64, int, ...MinhashOption) *Minhash{NewOnePermutationMinhash, NewWeightedMinhash} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected panic given a permutation scheme")
+				}
+			}()
+			newMinhash(1, 16, WithPermutationScheme(UniversalPermutations))
+		}()
+	}
+}
+
+func TestMurmur3Seed(t *testing.T) {
+	// Seeds differing only in their upper 32 bits give different hashes.
+	h1 := Murmur3.hashFunc(1)
+	h2 := Murmur3.hashFunc(1 | 1<<40)
+	if h1([]byte("a")) == h2([]byte("a")) {
+		t.Error("Murmur3 ignores the upper 32 bits of the seed")
+	}
+}
+
+func benchmarkPushFamily(b *testing.B, family HashFamily) {
+	benchmarkPush(b, NewMinhash(1, 256, WithHashFamily(family)))
+}
+
+func BenchmarkPushFNV64a(b *testing.B)   { benchmarkPushFamily(b, FNV64a) }
+func BenchmarkPushXXHash64(b *testing.B) { benchmarkPushFamily(b, XXHash64) }
+func BenchmarkPushMurmur3(b *testing.B)  { benchmarkPushFamily(b, Murmur3) }
+func BenchmarkPushSipHash(b *testing.B)  { benchmarkPushFamily(b, SipHash) }
@@ -1,75 +1,163 @@
 package lshensemble
 
 import (
-	"math"
+	"context"
 )
 
-// LshForestArray represents a MinHash LSH implemented using an array of LshForest.
+// LshForestArrayOf represents a MinHash LSH implemented using an array of LshForestOf,
+// with keys of type K.
 // It allows a wider range for the K and L parameters.
-type LshForestArray struct {
+type LshForestArrayOf[K comparable] struct {
 	maxK    int
 	numHash int
-	array   []*LshForest
+	array   []*LshForestOf[K]
 }
 
-// NewLshForestArray initializes with parameters:
+// LshForestArray represents a MinHash LSH implemented using an array of LshForest.
+// It allows a wider range for the K and L parameters.
+type LshForestArray = LshForestArrayOf[interface{}]
+
+// NewLshForestArrayOf initializes with keys of type K and parameters:
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
 // numHash is the number of hash functions in MinHash.
 // initSize is the initial size of underlying hash tables to allocate.
-func NewLshForestArray(maxK, numHash, initSize int) *LshForestArray {
-	array := make([]*LshForest, maxK)
+func NewLshForestArrayOf[K comparable](maxK, numHash, initSize int) *LshForestArrayOf[K] {
+	return newLshForestArray[K](maxK, numHash, defaultHashValueBits(), initSize)
+}
+
+func newLshForestArray[K comparable](maxK, numHash, hashValueBits, initSize int) *LshForestArrayOf[K] {
+	array := make([]*LshForestOf[K], maxK)
 	for k := 1; k <= maxK; k++ {
-		array[k-1] = NewLshForest(k, numHash/k, initSize)
+		array[k-1] = newLshForest[K](k, numHash/k, hashValueBits, initSize)
+		// The forests index the same keys, so they share a key table.
+		array[k-1].keyTable = array[0].keyTable
 	}
-	return &LshForestArray{
+	return &LshForestArrayOf[K]{
 		maxK:    maxK,
 		numHash: numHash,
 		array:   array,
 	}
 }
 
+// NewLshForestArray initializes with parameters:
+// maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
+// numHash is the number of hash functions in MinHash.
+// initSize is the initial size of underlying hash tables to allocate.
+func NewLshForestArray(maxK, numHash, initSize int) *LshForestArray {
+	return NewLshForestArrayOf[interface{}](maxK, numHash, initSize)
+}
+
+// cloneEmpty returns an empty array of forests with the same parameters.
+func (a *LshForestArrayOf[K]) cloneEmpty() LshOf[K] {
+	return newLshForestArray[K](a.maxK, a.numHash, a.array[0].hashValueBits, 0)
+}
+
+// clone returns a deep copy of the array of forests.
+func (a *LshForestArrayOf[K]) clone() LshOf[K] {
+	array := make([]*LshForestOf[K], len(a.array))
+	keys := a.array[0].keyTable.clone()
+	for i := range a.array {
+		array[i] = a.array[i].cloneWith(keys)
+	}
+	return &LshForestArrayOf[K]{
+		maxK:    a.maxK,
+		numHash: a.numHash,
+		array:   array,
+	}
+}
+
 // Add a key with MinHash signature into the index.
 // The key won't be searchable until Index() is called.
-func (a *LshForestArray) Add(key interface{}, sig []uint64) {
+func (a *LshForestArrayOf[K]) Add(key K, sig []uint64) {
 	for i := range a.array {
 		a.array[i].Add(key, sig)
 	}
 }
 
+// Remove a key from the index.
+// The key is no longer returned by Query, and its entries are
+// removed from the hash tables when Index() is called.
+func (a *LshForestArrayOf[K]) Remove(key K) {
+	for i := range a.array {
+		a.array[i].Remove(key)
+	}
+}
+
 // Index makes all the keys added searchable.
-func (a *LshForestArray) Index() {
+func (a *LshForestArrayOf[K]) Index() {
+	// Every forest returns the same removed keys, whose IDs are released
+	// once all forests are indexed.
+	var released []uint32
 	for i := range a.array {
-		a.array[i].Index()
+		released = a.array[i].index()
+	}
+	for _, id := range released {
+		a.array[0].release(id)
 	}
 }
 
 // Query returns candidate keys given the query signature and parameters.
-func (a *LshForestArray) Query(sig []uint64, K, L int, out chan<- interface{}, done <-chan struct{}) {
-	a.array[K-1].Query(sig, -1, L, out, done)
+func (a *LshForestArrayOf[K]) Query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) {
+	a.array[k-1].Query(sig, -1, l, out, done)
+}
+
+// validKL returns true if queries of the parameters K and L are
+// supported by the forest of K.
+func (a *LshForestArrayOf[K]) validKL(k, l int) bool {
+	return k >= 1 && k <= len(a.array) && a.array[k-1].validKL(k, l)
+}
+
+// numKeys returns the number of searchable keys, which have been
+// indexed and not removed.
+func (a *LshForestArrayOf[K]) numKeys() int {
+	return a.array[0].numKeys()
+}
+
+// hasKey returns true if the key is searchable.
+func (a *LshForestArrayOf[K]) hasKey(key K) bool {
+	return a.array[0].hasKey(key)
+}
+
+// QueryContext returns candidate keys given the query signature and parameters,
+// and stops when ctx is done, returning the context error.
+func (a *LshForestArrayOf[K]) QueryContext(ctx context.Context, sig []uint64, k, l int, out chan<- K) error {
+	if a.array[k-1].query(sig, -1, l, out, ctx.Done()) {
+		return ctx.Err()
+	}
+	return nil
 }
 
 // OptimalKL returns the optimal K and L for containment search,
 // and the false positive and negative probabilities.
 // where x is the indexed domain size, q is the query domain size,
 // and t is the containment threshold.
-func (a *LshForestArray) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64) {
-	minError := math.MaxFloat64
+func (a *LshForestArrayOf[K]) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return a.optimalKL(containmentMeasure, x, q, t, Objective{}, defaultIntegrationTolerance)
+}
+
+// OptimalKLJaccard returns the optimal K and L for Jaccard similarity
+// search, and the false positive and negative probabilities.
+// where x is the indexed domain size, q is the query domain size,
+// and t is the Jaccard similarity threshold.
+func (a *LshForestArrayOf[K]) OptimalKLJaccard(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return a.optimalKL(jaccardMeasure, x, q, t, Objective{}, defaultIntegrationTolerance)
+}
+
+// optimalKL searches the parameter space of K and L using at most
+// numHash hash functions for the optimal K and L under the objective
+// for the similarity measure m, integrating the probabilities with the
+// absolute error tolerance.
+func (a *LshForestArrayOf[K]) optimalKL(m measure, x, q int, t float64, obj Objective, tolerance float64) (optK, optL int, fp, fn float64) {
+	probs := measureProbs(m, x, q, a.array[0].hashValueBits, t, tolerance)
+	s := klSearch{obj: obj}
 	for l := 1; l <= a.numHash; l++ {
 		for k := 1; k <= a.maxK; k++ {
 			if k*l > a.numHash {
 				continue
 			}
-			currFp := probFalsePositive(x, q, l, k, t, integrationPrecision)
-			currFn := probFalseNegative(x, q, l, k, t, integrationPrecision)
-			currErr := currFn + currFp
-			if minError > currErr {
-				minError = currErr
-				optK = k
-				optL = l
-				fp = currFp
-				fn = currFn
-			}
+			currFp, currFn := probs(l, k)
+			s.add(k, l, currFp, currFn)
 		}
 	}
-	return
+	return s.result()
 }
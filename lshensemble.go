@@ -1,131 +1,488 @@
 package lshensemble
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	cmap "github.com/orcaman/concurrent-map"
 )
 
+var (
+	errNoMatchingPartition = errors.New("No matching partition found")
+)
+
 type param struct {
 	k int
 	l int
+	// fp and fn are the false positive and negative probabilities
+	// of k and l.
+	fp float64
+	fn float64
 }
 
+// measure is the similarity measure of the threshold of a query.
+type measure int
+
+const (
+	containmentMeasure measure = iota
+	jaccardMeasure
+)
+
 // Partition represents a domain size partition in the LSH Ensemble index.
 type Partition struct {
 	Lower int `json:"lower"`
 	Upper int `json:"upper"`
 }
 
-// Lsh interface is implemented by LshForst and LshForestArray.
-type Lsh interface {
+// LshOf interface is implemented by LshForestOf and LshForestArrayOf
+// with keys of type K.
+type LshOf[K comparable] interface {
 	// Add addes a new key into the index, it won't be searchable
 	// until the next time Index() is called since the add.
-	Add(key interface{}, sig []uint64)
+	Add(key K, sig []uint64)
+	// Remove deletes a key from the index, it won't be returned
+	// by Query immediately, and will be removed from the underlying
+	// hash tables the next time Index() is called.
+	Remove(key K)
 	// Index makes all keys added so far searchable.
 	Index()
 	// Query searches the index given a minhash signature, and
 	// the LSH parameters k and l. Result keys will be written to
 	// the channel out.
 	// Closing channel done will cancels the query execution.
-	Query(sig []uint64, k, l int, out chan<- interface{}, done <-chan struct{})
+	Query(sig []uint64, k, l int, out chan<- K, done <-chan struct{})
+	// QueryContext is similar to Query, but the query execution is
+	// canceled when ctx is done, in which case the context error
+	// is returned. A query that completes returns nil.
+	QueryContext(ctx context.Context, sig []uint64, k, l int, out chan<- K) error
 	// OptimalKL computes the optimal LSH parameters k and l given
 	// x, the index domain size, q, the query domain size, and t,
 	// the containment threshold. The resulting false positive (fp)
 	// and false negative (fn) probabilities are returned as well.
 	OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64)
+	// OptimalKLJaccard is similar to OptimalKL, but given t, the
+	// Jaccard similarity threshold.
+	OptimalKLJaccard(x, q int, t float64) (optK, optL int, fp, fn float64)
 }
 
-// LshEnsemble represents an LSH Ensemble index.
-type LshEnsemble struct {
+// Lsh interface is implemented by LshForst and LshForestArray.
+type Lsh = LshOf[interface{}]
+
+// LshEnsembleOf represents an LSH Ensemble index with keys of type K.
+type LshEnsembleOf[K comparable] struct {
 	Partitions []Partition
-	lshes      []Lsh
+	lshes      []LshOf[K]
 	maxK       int
 	numHash    int
 	paramCache cmap.ConcurrentMap
+	// objective is the objective of choosing the LSH parameters
+	// of queries given no other objective.
+	objective Objective
+	// tolerance is the absolute error tolerance of the integrals
+	// computing the false positive and negative probabilities.
+	tolerance float64
+	// minhash holds the hash family and permutation scheme expected of
+	// the MinHash objects given to PrepareMinhash and QueryMinhash.
+	minhash minhashConfig
+	// mergeThreshold is the merge threshold of the delta segments if the
+	// index is created using WithConcurrentInserts, and 0 otherwise.
+	mergeThreshold int
+	// paramTable holds the parameters precomputed by PrecomputeParams,
+	// it is nil if no parameters are precomputed.
+	paramTable *paramTable
+	// store retains the signatures and sizes of domains,
+	// it is nil unless WithSignatureStore is used.
+	store *signatureStore[K]
+	// mmapData is the memory mapping of the index file
+	// if the index is opened using OpenMmapLshEnsemble.
+	mmapData []byte
 }
 
-// NewLshEnsemble initializes a new index consists of MinHash LSH implemented using LshForest.
+// LshEnsemble represents an LSH Ensemble index.
+type LshEnsemble = LshEnsembleOf[interface{}]
+
+// config holds the settings given by options.
+type config struct {
+	signatureStore    bool
+	partitionBins     int
+	concurrentInserts bool
+	mergeThreshold    int
+	hashValueBits     int
+	objective         Objective
+	tolerance         float64
+	minhash           minhashConfig
+}
+
+func newConfig(opts []Option) config {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.hashValueBits == 0 {
+		c.hashValueBits = defaultHashValueBits()
+	}
+	if !validTolerance(c.tolerance) {
+		c.tolerance = defaultIntegrationTolerance
+	}
+	return c
+}
+
+// Option configures an LshEnsemble when it is created.
+type Option func(*config)
+
+// WithSignatureStore makes the index retain the signature and the size
+// of every domain added, which are required for ranking query results
+// by their estimated containment, e.g., using TopK.
+func WithSignatureStore() Option {
+	return func(c *config) {
+		c.signatureStore = true
+	}
+}
+
+// WithApproximatePartitioning makes the optimal bootstrap functions
+// coarsen the domain size distribution into at most numBins bins of
+// consecutive sizes before computing the optimal partitions, whose
+// boundaries are then restricted to the bin boundaries.
+// This bounds the time of partitioning when there are many distinct
+// domain sizes, at the cost of slightly more false positives.
+func WithApproximatePartitioning(numBins int) Option {
+	return func(c *config) {
+		c.partitionBins = numBins
+	}
+}
+
+// WithConcurrentInserts makes the index safe for calling Add, Prepare,
+// Remove and Update concurrently with queries, and added domains become
+// searchable immediately without calling Index().
+// The added domains are kept in a small delta segment of each partition,
+// which is queried along with the indexed main segment.
+// Once a delta segment has mergeThreshold domains, it is merged into a new
+// main segment in the background, which is swapped in when indexed.
+// Calling Index() merges all delta segments and waits for the merges.
+// If mergeThreshold is not positive, a default of 1024 is used.
+// The option is kept by WriteTo and ReadFrom, and domains not yet merged
+// are indexed when loaded. Indexes opened using OpenMmapLshEnsemble are
+// read-only and do not keep it.
+func WithConcurrentInserts(mergeThreshold int) Option {
+	return func(c *config) {
+		c.concurrentInserts = true
+		c.mergeThreshold = mergeThreshold
+	}
+}
+
+// WithHashValueBits makes the index trim the MinHash hash values to their
+// lowest hashValueBits bits, which must be from 1 to 8 (b-bit minwise
+// hashing), or a multiple of 8 up to 64.
+// Narrower hash values take less memory, and the optimal K and L are
+// computed accounting for the accidental collisions they cause.
+// The width is saved by WriteTo. If not given, the width of the forests
+// created by NewLshForest is used, which is 32 bits by default.
+// The constructors panic if hashValueBits is invalid.
+func WithHashValueBits(hashValueBits int) Option {
+	return func(c *config) {
+		c.hashValueBits = hashValueBits
+	}
+}
+
+// WithIntegrationTolerance sets the absolute error tolerance of the
+// numerical integration computing the false positive and negative
+// probabilities of the LSH parameters, which is 1e-6 if not given, not
+// positive or not finite. A larger tolerance computes the parameters of unseen
+// query sizes and thresholds faster, but less accurately.
+// The tolerance is saved by WriteTo.
+func WithIntegrationTolerance(tolerance float64) Option {
+	return func(c *config) {
+		c.tolerance = tolerance
+	}
+}
+
+// WithMinhashOptions records the hash family and permutation scheme of the
+// MinHash objects of the domains and queries, given as the same options
+// passed to their constructor, e.g., NewMinhash.
+// PrepareMinhash returns an error and QueryMinhash panics if given a
+// MinHash object created with another hash family or permutation scheme.
+// If not given, the defaults FNV64a and LinearPermutations are expected.
+// The options are saved by WriteTo.
+func WithMinhashOptions(opts ...MinhashOption) Option {
+	return func(c *config) {
+		c.minhash = newMinhashConfig(opts)
+	}
+}
+
+// NewLshEnsembleOf initializes a new index consists of MinHash LSH implemented using LshForest,
+// with keys of type K.
 // numHash is the number of hash functions in MinHash.
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
 // initSize is the initial size of underlying hash tables to allocate.
-func NewLshEnsemble(parts []Partition, numHash, maxK, initSize int) *LshEnsemble {
-	lshes := make([]Lsh, len(parts))
+// opts are the options to configure the index.
+func NewLshEnsembleOf[K comparable](parts []Partition, numHash, maxK, initSize int, opts ...Option) *LshEnsembleOf[K] {
+	e := newForestEnsemble[K](parts, numHash, maxK, initSize, opts)
+	e.wrapConcurrentInserts()
+	return e
+}
+
+// newForestEnsemble is NewLshEnsembleOf without wrapping the forests for
+// concurrent inserts, so domains can be bootstrapped into them directly.
+func newForestEnsemble[K comparable](parts []Partition, numHash, maxK, initSize int, opts []Option) *LshEnsembleOf[K] {
+	c := newConfig(opts)
+	lshes := make([]LshOf[K], len(parts))
 	for i := range lshes {
-		lshes[i] = NewLshForest(maxK, numHash/maxK, initSize)
-	}
-	return &LshEnsemble{
-		lshes:      lshes,
-		Partitions: parts,
-		maxK:       maxK,
-		numHash:    numHash,
-		paramCache: cmap.New(),
+		lshes[i] = newLshForest[K](maxK, numHash/maxK, c.hashValueBits, initSize)
 	}
+	return newLshEnsemble(parts, lshes, numHash, maxK, opts)
 }
 
-// NewLshEnsemblePlus initializes a new index consists of MinHash LSH implemented using LshForestArray.
+// NewLshEnsemble initializes a new index consists of MinHash LSH implemented using LshForest.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
+// initSize is the initial size of underlying hash tables to allocate.
+// opts are the options to configure the index.
+func NewLshEnsemble(parts []Partition, numHash, maxK, initSize int, opts ...Option) *LshEnsemble {
+	return NewLshEnsembleOf[interface{}](parts, numHash, maxK, initSize, opts...)
+}
+
+// NewLshEnsemblePlusOf initializes a new index consists of MinHash LSH implemented using LshForestArray,
+// with keys of type K.
 // numHash is the number of hash functions in MinHash.
 // maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
 // initSize is the initial size of underlying hash tables to allocate.
-func NewLshEnsemblePlus(parts []Partition, numHash, maxK, initSize int) *LshEnsemble {
-	lshes := make([]Lsh, len(parts))
+// opts are the options to configure the index.
+func NewLshEnsemblePlusOf[K comparable](parts []Partition, numHash, maxK, initSize int, opts ...Option) *LshEnsembleOf[K] {
+	e := newForestArrayEnsemble[K](parts, numHash, maxK, initSize, opts)
+	e.wrapConcurrentInserts()
+	return e
+}
+
+// newForestArrayEnsemble is NewLshEnsemblePlusOf without wrapping the
+// arrays of forests for concurrent inserts.
+func newForestArrayEnsemble[K comparable](parts []Partition, numHash, maxK, initSize int, opts []Option) *LshEnsembleOf[K] {
+	c := newConfig(opts)
+	lshes := make([]LshOf[K], len(parts))
 	for i := range lshes {
-		lshes[i] = NewLshForestArray(maxK, numHash, initSize)
+		lshes[i] = newLshForestArray[K](maxK, numHash, c.hashValueBits, initSize)
 	}
-	return &LshEnsemble{
+	return newLshEnsemble(parts, lshes, numHash, maxK, opts)
+}
+
+// NewLshEnsemblePlus initializes a new index consists of MinHash LSH implemented using LshForestArray.
+// numHash is the number of hash functions in MinHash.
+// maxK is the maximum value for the MinHash parameter K - the number of hash functions per "band".
+// initSize is the initial size of underlying hash tables to allocate.
+// opts are the options to configure the index.
+func NewLshEnsemblePlus(parts []Partition, numHash, maxK, initSize int, opts ...Option) *LshEnsemble {
+	return NewLshEnsemblePlusOf[interface{}](parts, numHash, maxK, initSize, opts...)
+}
+
+func newLshEnsemble[K comparable](parts []Partition, lshes []LshOf[K], numHash, maxK int, opts []Option) *LshEnsembleOf[K] {
+	c := newConfig(opts)
+	e := &LshEnsembleOf[K]{
 		lshes:      lshes,
 		Partitions: parts,
 		maxK:       maxK,
 		numHash:    numHash,
 		paramCache: cmap.New(),
+		objective:  c.objective,
+		tolerance:  c.tolerance,
+		minhash:    c.minhash,
+	}
+	if c.concurrentInserts {
+		e.mergeThreshold = c.mergeThreshold
+		if e.mergeThreshold <= 0 {
+			e.mergeThreshold = defaultMergeThreshold
+		}
+	}
+	if c.signatureStore {
+		e.store = newSignatureStore[K]()
+	}
+	return e
+}
+
+// wrapConcurrentInserts wraps the indexed Lsh of every partition for
+// concurrent inserts if the index is created using WithConcurrentInserts.
+// Memory-mapped forests are read-only and not wrapped.
+func (e *LshEnsembleOf[K]) wrapConcurrentInserts() {
+	if e.mergeThreshold == 0 {
+		return
+	}
+	for i := range e.lshes {
+		if lsh, ok := e.lshes[i].(cloneableLsh[K]); ok {
+			e.lshes[i] = newConcurrentLsh(lsh, e.mergeThreshold)
+		}
 	}
 }
 
 // Add a new domain to the index given its partition ID - the index of the partition.
 // The added domain won't be searchable until the Index() function is called.
-func (e *LshEnsemble) Add(key interface{}, sig []uint64, partInd int) {
+// The domain size is not given, so the domain is not kept in the signature
+// store, and its containment cannot be verified by QueryVerified, TopK or
+// QueryByKey. Use AddWithSize or Prepare to keep it.
+func (e *LshEnsembleOf[K]) Add(key K, sig []uint64, partInd int) {
+	e.lshes[partInd].Add(key, sig)
+	if e.store != nil {
+		e.store.remove(key)
+	}
+}
+
+// AddWithSize is the same as Add, but given the domain size, which is kept
+// in the signature store along with the signature if the store is enabled.
+func (e *LshEnsembleOf[K]) AddWithSize(key K, sig []uint64, size, partInd int) {
+	e.add(key, sig, size, partInd)
+}
+
+func (e *LshEnsembleOf[K]) add(key K, sig []uint64, size, partInd int) {
 	e.lshes[partInd].Add(key, sig)
+	if e.store != nil {
+		e.store.put(key, sig, size)
+	}
 }
 
 // Prepare adds a new domain to the index given its size, and partition will
 // be selected automatically. It could be more efficient to use Add().
 // The added domain won't be searchable until the Index() function is called.
-func (e *LshEnsemble) Prepare(key interface{}, sig []uint64, size int) error {
-	for i := range e.Partitions {
-		if size >= e.Partitions[i].Lower && size <= e.Partitions[i].Upper {
-			e.Add(key, sig, i)
-			break
-		}
+func (e *LshEnsembleOf[K]) Prepare(key K, sig []uint64, size int) error {
+	partInd, found := e.partitionIndex(size)
+	if !found {
+		return errNoMatchingPartition
+	}
+	e.add(key, sig, size, partInd)
+	return nil
+}
+
+// partitionIndex returns the index of the first partition containing
+// the domain size, and false if no partition contains it.
+func (e *LshEnsembleOf[K]) partitionIndex(size int) (int, bool) {
+	i := sort.Search(len(e.Partitions), func(i int) bool {
+		return e.Partitions[i].Upper >= size
+	})
+	if i < len(e.Partitions) && e.Partitions[i].Lower <= size {
+		return i, true
+	}
+	return 0, false
+}
+
+// Remove deletes a domain from the index.
+// The domain is excluded from query results immediately, and the
+// space it uses is reclaimed the next time the Index() function is called.
+func (e *LshEnsembleOf[K]) Remove(key K) {
+	for i := range e.lshes {
+		e.lshes[i].Remove(key)
+	}
+	if e.store != nil {
+		e.store.remove(key)
 	}
-	return errors.New("No matching partition found")
+}
+
+// Update replaces the signature and the size of an existing domain,
+// moving it to the partition matching the new size.
+// The updated domain won't be searchable until the Index() function is called.
+// If no partition matches the new size, an error is returned and the
+// domain is left unchanged.
+func (e *LshEnsembleOf[K]) Update(key K, sig []uint64, size int) error {
+	partInd, found := e.partitionIndex(size)
+	if !found {
+		return errNoMatchingPartition
+	}
+	e.Remove(key)
+	e.add(key, sig, size, partInd)
+	return nil
 }
 
 // Index makes all added domains searchable.
-func (e *LshEnsemble) Index() {
+func (e *LshEnsembleOf[K]) Index() {
 	for i := range e.lshes {
 		e.lshes[i].Index()
 	}
 }
 
+// Close releases the memory mapping of an index opened using
+// OpenMmapLshEnsemble. It does nothing for in-memory indexes.
+func (e *LshEnsembleOf[K]) Close() error {
+	data := e.mmapData
+	e.mmapData = nil
+	return munmapFile(data)
+}
+
 // Query returns the candidate domain keys in a channel.
 // This function is given the MinHash signature of the query domain, sig, the domain size,
 // the containment threshold, and a cancellation channel.
 // Closing channel done will cancel the query execution.
 // The query signature must be generated using the same seed as the signatures of the indexed domains,
 // and have the same number of hash functions.
-func (e *LshEnsemble) Query(sig []uint64, size int, threshold float64, done <-chan struct{}) <-chan interface{} {
-	params := e.computeParams(size, threshold)
+func (e *LshEnsembleOf[K]) Query(sig []uint64, size int, threshold float64, done <-chan struct{}) <-chan K {
+	params := e.computeParams(size, threshold, containmentMeasure, e.objective)
+	return e.queryWithParam(sig, params, done)
+}
+
+// QueryWithObjective is similar to Query, but the LSH parameters of every
+// partition are chosen using the objective rather than the objective of
+// the index, e.g., to favor recall for this query only.
+func (e *LshEnsembleOf[K]) QueryWithObjective(sig []uint64, size int, threshold float64, obj Objective, done <-chan struct{}) <-chan K {
+	params := e.computeParams(size, threshold, containmentMeasure, obj)
+	return e.queryWithParam(sig, params, done)
+}
+
+// QueryContainment is the same as Query, the threshold is the containment
+// of the query domain in the indexed domains.
+func (e *LshEnsembleOf[K]) QueryContainment(sig []uint64, size int, threshold float64, done <-chan struct{}) <-chan K {
+	return e.Query(sig, size, threshold, done)
+}
+
+// QueryJaccard is similar to Query, but the threshold is the Jaccard
+// similarity of the query domain and the indexed domains, and the LSH
+// parameters of every partition are optimized for Jaccard similarity.
+// The same index answers both containment and Jaccard similarity queries.
+func (e *LshEnsembleOf[K]) QueryJaccard(sig []uint64, size int, threshold float64, done <-chan struct{}) <-chan K {
+	params := e.computeParams(size, threshold, jaccardMeasure, e.objective)
 	return e.queryWithParam(sig, params, done)
 }
 
+// QueryContext returns the candidate domain keys in a channel, and a channel
+// that receives the query error after the key channel is closed.
+// This function is given a context, the MinHash signature of the query
+// domain, sig, the domain size, and the containment threshold.
+// Canceling ctx or exceeding its deadline stops the query execution, and
+// the context error is sent to the error channel. If the query completes,
+// nil is sent, even if ctx is done afterwards.
+// When the key channel is closed, all goroutines started for the query
+// have exited.
+func (e *LshEnsembleOf[K]) QueryContext(ctx context.Context, sig []uint64, size int, threshold float64) (<-chan K, <-chan error) {
+	params := e.computeParams(size, threshold, containmentMeasure, e.objective)
+	keyChan := make(chan K)
+	errChan := make(chan error, 1)
+	errs := make([]error, len(e.lshes))
+	var wg sync.WaitGroup
+	wg.Add(len(e.lshes))
+	for i := range e.lshes {
+		go func(i, k, l int) {
+			errs[i] = e.lshes[i].QueryContext(ctx, sig, k, l, keyChan)
+			wg.Done()
+		}(i, params[i].k, params[i].l)
+	}
+	go func() {
+		wg.Wait()
+		close(keyChan)
+		var err error
+		for _, partErr := range errs {
+			if partErr != nil {
+				err = partErr
+				break
+			}
+		}
+		errChan <- err
+		close(errChan)
+	}()
+	return keyChan, errChan
+}
+
 // QueryTimed is similar to Query, returns the candidate domain keys in a slice as well as the running time.
-func (e *LshEnsemble) QueryTimed(sig []uint64, size int, threshold float64) (result []interface{}, dur time.Duration) {
+func (e *LshEnsembleOf[K]) QueryTimed(sig []uint64, size int, threshold float64) (result []K, dur time.Duration) {
 	// Compute the optimal k and l for each partition
-	params := e.computeParams(size, threshold)
-	result = make([]interface{}, 0)
+	params := e.computeParams(size, threshold, containmentMeasure, e.objective)
+	result = make([]K, 0)
 	done := make(chan struct{})
 	defer close(done)
 	start := time.Now()
@@ -136,13 +493,13 @@ func (e *LshEnsemble) QueryTimed(sig []uint64, size int, threshold float64) (res
 	return result, dur
 }
 
-func (e *LshEnsemble) queryWithParam(sig []uint64, params []param, done <-chan struct{}) <-chan interface{} {
+func (e *LshEnsembleOf[K]) queryWithParam(sig []uint64, params []param, done <-chan struct{}) <-chan K {
 	// Collect candidates from all partitions
-	keyChan := make(chan interface{})
+	keyChan := make(chan K)
 	var wg sync.WaitGroup
 	wg.Add(len(e.lshes))
 	for i := range e.lshes {
-		go func(lsh Lsh, k, l int) {
+		go func(lsh LshOf[K], k, l int) {
 			lsh.Query(sig, k, l, keyChan, done)
 			wg.Done()
 		}(e.lshes[i], params[i].k, params[i].l)
@@ -154,17 +511,21 @@ func (e *LshEnsemble) queryWithParam(sig []uint64, params []param, done <-chan s
 	return keyChan
 }
 
-// Compute the optimal k and l for each partition
-func (e *LshEnsemble) computeParams(size int, threshold float64) []param {
+// Compute the optimal k and l for each partition under the objective
+func (e *LshEnsembleOf[K]) computeParams(size int, threshold float64, m measure, obj Objective) []param {
 	params := make([]param, len(e.Partitions))
 	for i, p := range e.Partitions {
 		x := p.Upper
-		key := cacheKey(x, size, threshold)
+		key := cacheKey(x, size, threshold, m, obj)
 		if cached, exist := e.paramCache.Get(key); exist {
 			params[i] = cached.(param)
+		} else if precomputed, ok := e.paramTable.lookup(i, x, size, threshold, m, obj); ok {
+			params[i] = precomputed
 		} else {
-			optK, optL, _, _ := e.lshes[i].OptimalKL(x, size, threshold)
-			computed := param{optK, optL}
+			// The Lsh of every partition is created by this package.
+			lsh := e.lshes[i].(objectiveLsh)
+			optK, optL, fp, fn := lsh.optimalKL(m, x, size, threshold, obj, e.tolerance)
+			computed := param{optK, optL, fp, fn}
 			e.paramCache.Set(key, computed)
 			params[i] = computed
 		}
@@ -173,6 +534,6 @@ func (e *LshEnsemble) computeParams(size int, threshold float64) []param {
 }
 
 // Make a cache key with threshold precision to 2 decimal points
-func cacheKey(x, q int, t float64) string {
-	return fmt.Sprintf("%.8x %.8x %.2f", x, q, t)
+func cacheKey(x, q int, t float64, m measure, obj Objective) string {
+	return fmt.Sprintf("%.8x %.8x %.2f %d %s", x, q, t, m, obj)
 }
@@ -1,8 +1,12 @@
 package lshensemble
 
 import (
+	"context"
+	"runtime"
 	"sort"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func Test_LshEnsembleEquiDepth(t *testing.T) {
@@ -102,3 +106,189 @@ func Test_LshEnsembleOptimal(t *testing.T) {
 		t.Fatal("unable to retrieve inserted key")
 	}
 }
+
+func Test_LshEnsembleRemoveUpdate(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	contains := func(key interface{}, rec *DomainRecord) bool {
+		result, _ := index.QueryTimed(rec.Signature, rec.Size, 0.9)
+		for _, k := range result {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+	index.Remove(recs[0].Key)
+	if contains(recs[0].Key, recs[0]) {
+		t.Fatal("removed key returned")
+	}
+	// Move the key to the last partition using the signature of
+	// the largest domain.
+	last := recs[len(recs)-1]
+	if err := index.Update(recs[0].Key, last.Signature, last.Size); err != nil {
+		t.Fatal(err)
+	}
+	index.Index()
+	if contains(recs[0].Key, recs[0]) {
+		t.Fatal("updated key returned for its old signature")
+	}
+	if !contains(recs[0].Key, last) {
+		t.Fatal("unable to retrieve updated key")
+	}
+	if err := index.Update(recs[0].Key, last.Signature, last.Size+1); err == nil {
+		t.Fatal("expecting error for a size out of all partitions")
+	}
+	index.Index()
+	if !contains(recs[0].Key, last) {
+		t.Fatal("failed update removed the key")
+	}
+}
+
+func Test_LshEnsembleQueryContext(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		expected, _ := index.QueryTimed(rec.Signature, rec.Size, 0.5)
+		keys, errs := index.QueryContext(context.Background(),
+			rec.Signature, rec.Size, 0.5)
+		var result []interface{}
+		for key := range keys {
+			result = append(result, key)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != len(expected) {
+			t.Fatal("QueryContext results differ from Query", result, expected)
+		}
+	}
+}
+
+func Test_LshEnsembleQueryContextCancel(t *testing.T) {
+	sig := randomSignature(128, 1)
+	for _, opts := range [][]Option{nil, {WithConcurrentInserts(0)}} {
+		index := NewLshEnsemble([]Partition{{1, 10}, {11, 20}}, 128, 4, 0, opts...)
+		// Every domain has the same signature, so all of them are candidates.
+		for i := 0; i < 200; i++ {
+			index.Add(i, sig, i%2)
+		}
+		index.Index()
+		before := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		keys, errs := index.QueryContext(ctx, sig, 10, 0.5)
+		// Cancel while the results are being consumed.
+		<-keys
+		cancel()
+		numKeys := 1
+		for range keys {
+			numKeys++
+		}
+		if err := <-errs; err != context.Canceled {
+			t.Fatal("expecting context canceled error, got", err)
+		}
+		if numKeys == 200 {
+			t.Fatal("query not stopped by cancellation")
+		}
+		for i := 0; runtime.NumGoroutine() > before; i++ {
+			if i == 100 {
+				t.Fatal("query goroutines still running after cancellation")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func Test_LshEnsembleOfTypedKeys(t *testing.T) {
+	recs := make([]*DomainRecordOf[uint32], 0)
+	for i, rec := range testDomainRecords(128) {
+		recs = append(recs, &DomainRecordOf[uint32]{
+			Key:       uint32(i),
+			Size:      rec.Size,
+			Signature: rec.Signature,
+		})
+	}
+	sort.Sort(BySizeOf[uint32](recs))
+	index, err := BootstrapLshEnsemblePlusOptimalOf(2, 128, 4,
+		func() <-chan *DomainRecordOf[uint32] { return Recs2ChanOf(recs) },
+		WithSignatureStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		result, _ := index.QueryTimed(rec.Signature, rec.Size, 0.9)
+		var found bool
+		for _, key := range result {
+			if key == rec.Key {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("unable to retrieve inserted key")
+		}
+		top, err := index.TopK(rec.Signature, rec.Size, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(top) != 1 || top[0].Key != rec.Key {
+			t.Fatal("query domain is not the top result", top)
+		}
+	}
+}
+
+func Test_LshEnsembleQueryJaccard(t *testing.T) {
+	numHash := 256
+	minhashOf := func(values []string) []uint64 {
+		mh := NewMinhash(1, numHash)
+		for _, v := range values {
+			mh.Push([]byte(v))
+		}
+		return mh.Signature()
+	}
+	query := make([]string, 10)
+	superset := make([]string, 100)
+	for i := range superset {
+		superset[i] = strconv.Itoa(i)
+	}
+	copy(query, superset)
+	builders := map[string]func([]Partition) *LshEnsemble{
+		"LshForest": func(parts []Partition) *LshEnsemble {
+			return NewLshEnsemble(parts, numHash, 4, 2)
+		},
+		"LshForestArray": func(parts []Partition) *LshEnsemble {
+			return NewLshEnsemblePlus(parts, numHash, 4, 2)
+		},
+	}
+	for name, build := range builders {
+		index := build([]Partition{{1, 10}, {11, 100}})
+		// "same" has Jaccard 1.0 and containment 1.0, while "superset" has
+		// Jaccard 0.1 and containment 1.0.
+		index.Prepare("same", minhashOf(query), len(query))
+		index.Prepare("superset", minhashOf(superset), len(superset))
+		index.Index()
+		collect := func(keys <-chan interface{}) map[interface{}]bool {
+			found := make(map[interface{}]bool)
+			for key := range keys {
+				found[key] = true
+			}
+			return found
+		}
+		sig := minhashOf(query)
+		containment := collect(index.QueryContainment(sig, len(query), 0.8, nil))
+		if !containment["same"] || !containment["superset"] {
+			t.Errorf("%s: containment query expected both domains, got %v", name, containment)
+		}
+		jaccard := collect(index.QueryJaccard(sig, len(query), 0.8, nil))
+		if !jaccard["same"] || jaccard["superset"] {
+			t.Errorf("%s: Jaccard query expected only the same domain, got %v", name, jaccard)
+		}
+	}
+}
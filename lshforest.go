@@ -1,164 +1,522 @@
 package lshensemble
 
 import (
+	"bytes"
+	"context"
 	"math"
 	"sort"
 )
 
-const (
-	integrationPrecision = 0.01
-)
-
 // NewLshForest default constructor uses 32 bit hash value
 var NewLshForest = NewLshForest32
 
-// entry contains the hash key (from minhash signature) and the indexed key
-type entry struct {
-	hashKey string
-	key     interface{}
+// defaultHashValueBits returns the number of bits of the hash values of
+// the forests created by NewLshForest, which is used by the LSH Ensemble
+// constructors unless WithHashValueBits is given.
+func defaultHashValueBits() int {
+	return NewLshForest(1, 1, 0).hashValueBits
 }
 
-// hashTable is a look-up table implemented as a slice sorted by hash keys.
+// hashTable is a look-up table sorted by hash keys (from minhash signature).
+// The fixed-width hash keys are stored in a flat byte slice, and the
+// IDs of the indexed keys are stored in a parallel slice.
 // Look-up operation is implemented using binary search.
-type hashTable []entry
+type hashTable struct {
+	hashKeySize int
+	hashKeys    []byte
+	ids         []uint32
+}
 
-func (h hashTable) Len() int           { return len(h) }
-func (h hashTable) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-func (h hashTable) Less(i, j int) bool { return h[i].hashKey < h[j].hashKey }
+func newHashTable(hashKeySize, initSize int) hashTable {
+	return hashTable{
+		hashKeySize: hashKeySize,
+		hashKeys:    make([]byte, 0, hashKeySize*initSize),
+		ids:         make([]uint32, 0, initSize),
+	}
+}
 
-// LshForest represents a MinHash LSH implemented using LSH Forest
-// (http://ilpubs.stanford.edu:8090/678/1/2005-14.pdf).
+func (h *hashTable) Len() int { return len(h.ids) }
+func (h *hashTable) Less(i, j int) bool {
+	return bytes.Compare(h.hashKey(i), h.hashKey(j)) < 0
+}
+func (h *hashTable) Swap(i, j int) {
+	a, b := h.hashKey(i), h.hashKey(j)
+	for x := range a {
+		a[x], b[x] = b[x], a[x]
+	}
+	h.ids[i], h.ids[j] = h.ids[j], h.ids[i]
+}
+
+func (h *hashTable) hashKey(i int) []byte {
+	return h.hashKeys[i*h.hashKeySize : (i+1)*h.hashKeySize]
+}
+
+func (h *hashTable) add(hashKey string, id uint32) {
+	h.hashKeys = append(h.hashKeys, hashKey...)
+	h.ids = append(h.ids, id)
+}
+
+// filter deletes the entries in the range [start, end) whose IDs are
+// removed, and moves the following entries forward.
+func (h *hashTable) filter(start, end int, removed func(id uint32) bool) {
+	n := start
+	for j := start; j < h.Len(); j++ {
+		if j < end && removed(h.ids[j]) {
+			continue
+		}
+		copy(h.hashKey(n), h.hashKey(j))
+		h.ids[n] = h.ids[j]
+		n++
+	}
+	h.hashKeys = h.hashKeys[:n*h.hashKeySize]
+	h.ids = h.ids[:n]
+}
+
+// merge sorts the entries from n on, and merges them into the sorted
+// entries before n, so indexing a few added keys takes linear time.
+func (h *hashTable) merge(n int) {
+	tail := hashTable{
+		hashKeySize: h.hashKeySize,
+		hashKeys:    append([]byte(nil), h.hashKeys[n*h.hashKeySize:]...),
+		ids:         append([]uint32(nil), h.ids[n:]...),
+	}
+	sort.Sort(&tail)
+	// Merge from the back, so the sorted entries are moved at most once.
+	i, j := n-1, tail.Len()-1
+	for w := h.Len() - 1; j >= 0; w-- {
+		if i >= 0 && bytes.Compare(h.hashKey(i), tail.hashKey(j)) > 0 {
+			copy(h.hashKey(w), h.hashKey(i))
+			h.ids[w] = h.ids[i]
+			i--
+		} else {
+			copy(h.hashKey(w), tail.hashKey(j))
+			h.ids[w] = tail.ids[j]
+			j--
+		}
+	}
+}
+
+// keyTable interns the keys into dense uint32 IDs. The forests of an
+// LshForestArrayOf index the same keys, so they share one keyTable.
+type keyTable[K comparable] struct {
+	// keys maps IDs to the keys, and ids maps keys to their IDs.
+	keys []K
+	ids  map[K]uint32
+	// freeIDs are the IDs released by removed keys for reuse.
+	freeIDs []uint32
+	// searchable marks the IDs of the keys which are indexed and not
+	// removed, and numSearchable is their number.
+	searchable    []bool
+	numSearchable int
+}
+
+func newKeyTable[K comparable](initSize int) *keyTable[K] {
+	return &keyTable[K]{
+		keys:       make([]K, 0, initSize),
+		ids:        make(map[K]uint32, initSize),
+		searchable: make([]bool, 0, initSize),
+	}
+}
+
+// intern returns the ID of the key, assigning a new ID if the key
+// is not in the table.
+func (t *keyTable[K]) intern(key K) uint32 {
+	if id, exists := t.ids[key]; exists {
+		return id
+	}
+	var id uint32
+	if n := len(t.freeIDs); n > 0 {
+		id = t.freeIDs[n-1]
+		t.freeIDs = t.freeIDs[:n-1]
+		t.keys[id] = key
+	} else {
+		if uint64(len(t.keys)) > math.MaxUint32 {
+			panic("LSH Forest cannot hold more than 2^32 keys")
+		}
+		id = uint32(len(t.keys))
+		t.keys = append(t.keys, key)
+		t.searchable = append(t.searchable, false)
+	}
+	t.ids[key] = id
+	return id
+}
+
+// release frees the ID of a key no longer in the table.
+func (t *keyTable[K]) release(id uint32) {
+	var zero K
+	delete(t.ids, t.keys[id])
+	t.keys[id] = zero
+	t.freeIDs = append(t.freeIDs, id)
+}
+
+// setSearchable marks whether the key of the ID is searchable, and
+// updates the number of searchable keys.
+func (t *keyTable[K]) setSearchable(id uint32, searchable bool) {
+	if t.searchable[id] == searchable {
+		return
+	}
+	t.searchable[id] = searchable
+	if searchable {
+		t.numSearchable++
+	} else {
+		t.numSearchable--
+	}
+}
+
+// numKeys returns the number of searchable keys.
+func (t *keyTable[K]) numKeys() int {
+	return t.numSearchable
+}
+
+// hasKey returns true if the key is searchable.
+func (t *keyTable[K]) hasKey(key K) bool {
+	id, exists := t.ids[key]
+	return exists && t.searchable[id]
+}
+
+// clone returns a deep copy of the table.
+func (t *keyTable[K]) clone() *keyTable[K] {
+	c := &keyTable[K]{
+		keys:          append([]K(nil), t.keys...),
+		ids:           make(map[K]uint32, len(t.ids)),
+		freeIDs:       append([]uint32(nil), t.freeIDs...),
+		searchable:    append([]bool(nil), t.searchable...),
+		numSearchable: t.numSearchable,
+	}
+	for key, id := range t.ids {
+		c.ids[key] = id
+	}
+	return c
+}
+
+// LshForestOf represents a MinHash LSH implemented using LSH Forest
+// (http://ilpubs.stanford.edu:8090/678/1/2005-14.pdf),
+// with keys of type K.
 // It supports query-time setting of the MinHash LSH parameters
 // L (number of bands) and
 // K (number of hash functions per band).
-type LshForest struct {
+// The keys are interned into dense uint32 IDs, so every hash table
+// entry takes only the size of its hash key plus 4 bytes.
+type LshForestOf[K comparable] struct {
 	k              int
 	l              int
 	hashTables     []hashTable
 	hashKeyFunc    hashKeyFunc
-	hashValueSize  int
+	hashValueBits  int
 	numIndexedKeys int
+	*keyTable[K]
+	// tombstones are the IDs of removed keys that are still in the
+	// indexed part of the hash tables.
+	tombstones map[uint32]bool
 }
 
-func newLshForest(k, l, hashValueSize, initSize int) *LshForest {
+// LshForest represents a MinHash LSH implemented using LSH Forest
+// (http://ilpubs.stanford.edu:8090/678/1/2005-14.pdf).
+// It supports query-time setting of the MinHash LSH parameters
+// L (number of bands) and
+// K (number of hash functions per band).
+type LshForest = LshForestOf[interface{}]
+
+func newLshForest[K comparable](k, l, hashValueBits, initSize int) *LshForestOf[K] {
 	if k < 0 || l < 0 {
 		panic("k and l must be positive")
 	}
+	if !validHashValueBits(hashValueBits) {
+		panic("hashValueBits must be from 1 to 8, or a multiple of 8 up to 64")
+	}
 	hashTables := make([]hashTable, l)
 	for i := range hashTables {
-		hashTables[i] = make(hashTable, 0, initSize)
+		hashTables[i] = newHashTable(hashKeySize(k, hashValueBits), initSize)
 	}
-	return &LshForest{
+	return &LshForestOf[K]{
 		k:              k,
 		l:              l,
-		hashValueSize:  hashValueSize,
+		hashValueBits:  hashValueBits,
 		hashTables:     hashTables,
-		hashKeyFunc:    hashKeyFuncGen(hashValueSize),
+		hashKeyFunc:    hashKeyFuncGen(hashValueBits),
 		numIndexedKeys: 0,
+		keyTable:       newKeyTable[K](initSize),
+		tombstones:     make(map[uint32]bool),
 	}
 }
 
+// NewLshForest64Of uses 64-bit hash values, and keys of type K.
+func NewLshForest64Of[K comparable](k, l, initSize int) *LshForestOf[K] {
+	return newLshForest[K](k, l, 64, initSize)
+}
+
+// NewLshForest32Of uses 32-bit hash values, and keys of type K.
+// MinHash signatures with 64 bit hash values will have
+// their hash values trimed.
+func NewLshForest32Of[K comparable](k, l, initSize int) *LshForestOf[K] {
+	return newLshForest[K](k, l, 32, initSize)
+}
+
+// NewLshForest16Of uses 16-bit hash values, and keys of type K.
+// MinHash signatures with 64 or 32 bit hash values will have
+// their hash values trimed.
+func NewLshForest16Of[K comparable](k, l, initSize int) *LshForestOf[K] {
+	return newLshForest[K](k, l, 16, initSize)
+}
+
+// NewLshForest8Of uses 8-bit hash values, and keys of type K.
+// MinHash signatures with wider hash values will have
+// their hash values trimed.
+func NewLshForest8Of[K comparable](k, l, initSize int) *LshForestOf[K] {
+	return newLshForest[K](k, l, 8, initSize)
+}
+
+// NewLshForestBitsOf uses hash values trimmed to their lowest
+// hashValueBits bits, and keys of type K.
+// hashValueBits must be from 1 to 8 (b-bit minwise hashing),
+// or a multiple of 8 up to 64.
+// Narrower hash values take less memory, at the cost of more
+// false positives caused by accidental collisions.
+func NewLshForestBitsOf[K comparable](k, l, hashValueBits, initSize int) *LshForestOf[K] {
+	return newLshForest[K](k, l, hashValueBits, initSize)
+}
+
 // NewLshForest64 uses 64-bit hash values.
 func NewLshForest64(k, l, initSize int) *LshForest {
-	return newLshForest(k, l, 8, initSize)
+	return NewLshForest64Of[interface{}](k, l, initSize)
 }
 
 // NewLshForest32 uses 32-bit hash values.
 // MinHash signatures with 64 bit hash values will have
 // their hash values trimed.
 func NewLshForest32(k, l, initSize int) *LshForest {
-	return newLshForest(k, l, 4, initSize)
+	return NewLshForest32Of[interface{}](k, l, initSize)
 }
 
 // NewLshForest16 uses 16-bit hash values.
 // MinHash signatures with 64 or 32 bit hash values will have
 // their hash values trimed.
 func NewLshForest16(k, l, initSize int) *LshForest {
-	return newLshForest(k, l, 2, initSize)
+	return NewLshForest16Of[interface{}](k, l, initSize)
 }
 
-func (f *LshForest) hashKeys(sig []uint64, K int) []string {
+// NewLshForest8 uses 8-bit hash values.
+// MinHash signatures with wider hash values will have
+// their hash values trimed.
+func NewLshForest8(k, l, initSize int) *LshForest {
+	return NewLshForest8Of[interface{}](k, l, initSize)
+}
+
+// NewLshForestBits uses hash values trimmed to their lowest
+// hashValueBits bits, see NewLshForestBitsOf.
+func NewLshForestBits(k, l, hashValueBits, initSize int) *LshForest {
+	return NewLshForestBitsOf[interface{}](k, l, hashValueBits, initSize)
+}
+
+func (f *LshForestOf[K]) hashKeys(sig []uint64, k int) []string {
 	hs := make([]string, f.l)
 	for i := 0; i < f.l; i++ {
-		hs[i] = f.hashKeyFunc(sig[i*f.k : i*f.k+K])
+		hs[i] = f.hashKeyFunc(sig[i*f.k : i*f.k+k])
 	}
 	return hs
 }
 
+// cloneEmpty returns an empty forest with the same parameters.
+func (f *LshForestOf[K]) cloneEmpty() LshOf[K] {
+	return newLshForest[K](f.k, f.l, f.hashValueBits, 0)
+}
+
+// clone returns a deep copy of the forest.
+func (f *LshForestOf[K]) clone() LshOf[K] {
+	return f.cloneWith(f.keyTable.clone())
+}
+
+// cloneWith returns a deep copy of the forest using the key table,
+// which is a copy of the key table of the forest.
+func (f *LshForestOf[K]) cloneWith(keys *keyTable[K]) *LshForestOf[K] {
+	c := *f
+	c.hashTables = make([]hashTable, len(f.hashTables))
+	for i, ht := range f.hashTables {
+		c.hashTables[i] = hashTable{
+			hashKeySize: ht.hashKeySize,
+			hashKeys:    append([]byte(nil), ht.hashKeys...),
+			ids:         append([]uint32(nil), ht.ids...),
+		}
+	}
+	c.keyTable = keys
+	c.tombstones = make(map[uint32]bool, len(f.tombstones))
+	for id := range f.tombstones {
+		c.tombstones[id] = true
+	}
+	return &c
+}
+
 // Add a key with MinHash signature into the index.
 // The key won't be searchable until Index() is called.
-func (f *LshForest) Add(key interface{}, sig []uint64) {
+func (f *LshForestOf[K]) Add(key K, sig []uint64) {
+	id := f.intern(key)
 	// Generate hash keys
 	hs := f.hashKeys(sig, f.k)
 	// Insert keys into the hash tables by appending.
 	for i := range f.hashTables {
-		f.hashTables[i] = append(f.hashTables[i], entry{hs[i], key})
+		f.hashTables[i].add(hs[i], id)
+	}
+}
+
+// Remove a key from the index.
+// The key is no longer returned by Query, and its entries are
+// removed from the hash tables when Index() is called.
+func (f *LshForestOf[K]) Remove(key K) {
+	id, exists := f.ids[key]
+	if !exists {
+		return
+	}
+	// Entries not yet indexed can be deleted directly.
+	for i := range f.hashTables {
+		ht := &f.hashTables[i]
+		ht.filter(f.numIndexedKeys, ht.Len(), func(x uint32) bool {
+			return x == id
+		})
 	}
+	f.tombstones[id] = true
+	f.setSearchable(id, false)
 }
 
 // Index makes all the keys added searchable.
-func (f *LshForest) Index() {
+func (f *LshForestOf[K]) Index() {
+	for _, id := range f.index() {
+		f.release(id)
+	}
+}
+
+// index makes all the keys added searchable, and returns the IDs of the
+// removed keys to release, which are released once by Index, or by the
+// LshForestArrayOf sharing the key table after indexing all forests.
+func (f *LshForestOf[K]) index() []uint32 {
+	var released []uint32
+	if len(f.tombstones) > 0 {
+		// Removed keys added again keep their IDs.
+		readded := make(map[uint32]bool)
+		for _, id := range f.hashTables[0].ids[f.numIndexedKeys:] {
+			if f.tombstones[id] {
+				readded[id] = true
+			}
+		}
+		// Delete the entries of removed keys from the indexed part,
+		// which stays sorted.
+		n := f.hashTables[0].Len()
+		for i := range f.hashTables {
+			ht := &f.hashTables[i]
+			ht.filter(0, f.numIndexedKeys, func(id uint32) bool {
+				return f.tombstones[id]
+			})
+		}
+		f.numIndexedKeys -= n - f.hashTables[0].Len()
+		for id := range f.tombstones {
+			if !readded[id] {
+				released = append(released, id)
+			}
+		}
+		f.tombstones = make(map[uint32]bool)
+	}
+	for _, id := range f.hashTables[0].ids[f.numIndexedKeys:] {
+		f.setSearchable(id, true)
+	}
 	for i := range f.hashTables {
-		sort.Sort(f.hashTables[i])
+		f.hashTables[i].merge(f.numIndexedKeys)
 	}
-	f.numIndexedKeys = len(f.hashTables[0])
+	f.numIndexedKeys = f.hashTables[0].Len()
+	return released
 }
 
 // Query returns candidate keys given the query signature and parameters.
-func (f *LshForest) Query(sig []uint64, K, L int, out chan<- interface{}, done <-chan struct{}) {
-	if K == -1 {
-		K = f.k
+func (f *LshForestOf[K]) Query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) {
+	f.query(sig, k, l, out, done)
+}
+
+// query is the same as Query, and returns true if it is stopped by
+// closing done.
+func (f *LshForestOf[K]) query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) bool {
+	if k == -1 {
+		k = f.k
 	}
-	if L == -1 {
-		L = f.l
+	if l == -1 {
+		l = f.l
 	}
-	prefixSize := f.hashValueSize * K
+	prefixBits := f.hashValueBits * k
 	// Generate hash keys
-	hashKeys := f.hashKeys(sig, K)
-	seens := make(map[interface{}]bool)
-	for i := 0; i < L; i++ {
+	hashKeys := f.hashKeys(sig, k)
+	seens := make(map[uint32]bool)
+	for i := 0; i < l; i++ {
 		// Only search over indexed keys.
-		ht := f.hashTables[i][:f.numIndexedKeys]
-		hk := hashKeys[i]
-		k := sort.Search(len(ht), func(x int) bool {
-			return ht[x].hashKey[:prefixSize] >= hk
+		ht := &f.hashTables[i]
+		hk := []byte(hashKeys[i])
+		start := sort.Search(f.numIndexedKeys, func(x int) bool {
+			return comparePrefix(ht.hashKey(x), hk, prefixBits) >= 0
 		})
-		if k < len(ht) && ht[k].hashKey[:prefixSize] == hk {
-			for j := k; j < len(ht) && ht[j].hashKey[:prefixSize] == hk; j++ {
-				key := ht[j].key
-				if _, seen := seens[key]; seen {
-					continue
-				}
-				seens[key] = true
-				select {
-				case out <- key:
-				case <-done:
-					return
-				}
+		for j := start; j < f.numIndexedKeys &&
+			comparePrefix(ht.hashKey(j), hk, prefixBits) == 0; j++ {
+			id := ht.ids[j]
+			if _, seen := seens[id]; seen {
+				continue
+			}
+			if f.tombstones[id] {
+				continue
+			}
+			seens[id] = true
+			select {
+			case out <- f.keys[id]:
+			case <-done:
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// QueryContext returns candidate keys given the query signature and parameters,
+// and stops when ctx is done, returning the context error.
+func (f *LshForestOf[K]) QueryContext(ctx context.Context, sig []uint64, k, l int, out chan<- K) error {
+	if f.query(sig, k, l, out, ctx.Done()) {
+		return ctx.Err()
+	}
+	return nil
 }
 
 // OptimalKL returns the optimal K and L for containment search,
 // and the false positive and negative probabilities.
 // where x is the indexed domain size, q is the query domain size,
 // and t is the containment threshold.
-func (f *LshForest) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64) {
-	minError := math.MaxFloat64
-	for l := 1; l <= f.l; l++ {
-		for k := 1; k <= f.k; k++ {
-			currFp := probFalsePositive(x, q, l, k, t, integrationPrecision)
-			currFn := probFalseNegative(x, q, l, k, t, integrationPrecision)
-			currErr := currFn + currFp
-			if minError > currErr {
-				minError = currErr
-				optK = k
-				optL = l
-				fp = currFp
-				fn = currFn
-			}
+func (f *LshForestOf[K]) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return f.optimalKL(containmentMeasure, x, q, t, Objective{}, defaultIntegrationTolerance)
+}
+
+// OptimalKLJaccard returns the optimal K and L for Jaccard similarity
+// search, and the false positive and negative probabilities.
+// where x is the indexed domain size, q is the query domain size,
+// and t is the Jaccard similarity threshold.
+func (f *LshForestOf[K]) OptimalKLJaccard(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return f.optimalKL(jaccardMeasure, x, q, t, Objective{}, defaultIntegrationTolerance)
+}
+
+// optimalKL returns the optimal K and L under the objective for
+// the similarity measure m, integrating the probabilities with the
+// absolute error tolerance.
+func (f *LshForestOf[K]) optimalKL(m measure, x, q int, t float64, obj Objective, tolerance float64) (optK, optL int, fp, fn float64) {
+	return forestOptimalKL(f.k, f.l, measureProbs(m, x, q, f.hashValueBits, t, tolerance), obj)
+}
+
+// validKL returns true if queries of the parameters K and L are
+// supported by the forest.
+func (f *LshForestOf[K]) validKL(k, l int) bool {
+	return k >= 1 && k <= f.k && l >= 1 && l <= f.l
+}
+
+// forestOptimalKL searches the parameter space of an LSH Forest
+// with maximum K maxK and L numTree for the optimal K and L under
+// the objective, given the false positive and negative probabilities.
+func forestOptimalKL(maxK, numTree int, probs probFunc, obj Objective) (optK, optL int, fp, fn float64) {
+	s := klSearch{obj: obj}
+	for l := 1; l <= numTree; l++ {
+		for k := 1; k <= maxK; k++ {
+			currFp, currFn := probs(l, k)
+			s.add(k, l, currFp, currFn)
 		}
 	}
-	return
+	return s.result()
 }
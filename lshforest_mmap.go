@@ -0,0 +1,304 @@
+package lshensemble
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// MmapLshForestOf is a read-only LSH Forest with keys of type K, whose
+// sorted hash tables are stored in a file written by LshForestOf.WriteTo or
+// LshEnsembleOf.WriteTo, and accessed through memory mapping.
+// Only the table of keys is loaded into memory, and multiple processes
+// opening the same file share the mapped hash tables.
+type MmapLshForestOf[K comparable] struct {
+	k              int
+	l              int
+	hashValueBits  int
+	numIndexedKeys int
+	numEntries     int
+	keys           []K
+	tombstones     map[uint32]bool
+	// numSearchable is the number of keys indexed and not removed.
+	numSearchable int
+	// tables holds l hash tables of numEntries fixed-width entries,
+	// each entry is a hash key followed by the uint32 position of
+	// its key in keys.
+	tables      []byte
+	hashKeyFunc hashKeyFunc
+	// data is the memory mapping owned by this forest, it is nil
+	// if the mapping is shared with other forests.
+	data []byte
+}
+
+// MmapLshForest is a read-only LSH Forest whose sorted hash tables
+// are stored in a file written by LshForest.WriteTo or
+// LshEnsemble.WriteTo, and accessed through memory mapping.
+type MmapLshForest = MmapLshForestOf[interface{}]
+
+// OpenMmapLshForestOf opens the LSH Forest file at path written by
+// LshForestOf.WriteTo, with keys of type K.
+// Only keys indexed before the file was written are searchable.
+// Close must be called to release the memory mapping.
+func OpenMmapLshForestOf[K comparable](path string) (*MmapLshForestOf[K], error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	if err := readMagic(r, forestMagic, errForestMagic); err != nil {
+		munmapFile(data)
+		return nil, err
+	}
+	f, err := parseMmapLshForest[K](r, data)
+	if err != nil {
+		munmapFile(data)
+		return nil, err
+	}
+	f.data = data
+	return f, nil
+}
+
+// OpenMmapLshForest opens the LSH Forest file at path written by
+// LshForest.WriteTo.
+// Only keys indexed before the file was written are searchable.
+// Close must be called to release the memory mapping.
+func OpenMmapLshForest(path string) (*MmapLshForest, error) {
+	return OpenMmapLshForestOf[interface{}](path)
+}
+
+// OpenMmapLshEnsembleOf opens the index file at path written by
+// LshEnsembleOf.WriteTo, with keys of type K, and every partition served
+// by an MmapLshForestOf sharing a single memory mapping of the file.
+// Only indexes consisting of LshForestOf are supported.
+// The returned index is read-only, and Close must be called to release
+// the memory mapping.
+func OpenMmapLshEnsembleOf[K comparable](path string) (*LshEnsembleOf[K], error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseMmapLshEnsemble[K](data)
+	if err != nil {
+		munmapFile(data)
+		return nil, err
+	}
+	return e, nil
+}
+
+// OpenMmapLshEnsemble opens the index file at path written by
+// LshEnsemble.WriteTo, with every partition served by an MmapLshForest
+// sharing a single memory mapping of the file.
+// Only indexes consisting of LshForest are supported.
+// The returned index is read-only, and Close must be called to release
+// the memory mapping.
+func OpenMmapLshEnsemble(path string) (*LshEnsemble, error) {
+	return OpenMmapLshEnsembleOf[interface{}](path)
+}
+
+func parseMmapLshEnsemble[K comparable](data []byte) (*LshEnsembleOf[K], error) {
+	r := bytes.NewReader(data)
+	numHash, maxK, partitions, err := readIndexHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	lshes := make([]LshOf[K], len(partitions))
+	for i := range lshes {
+		kind, err := readUints(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		if kind[0] != lshKindForest {
+			return nil, errLshKind
+		}
+		if lshes[i], err = parseMmapLshForest[K](r, data); err != nil {
+			return nil, err
+		}
+	}
+	e := newLshEnsemble(partitions, lshes, numHash, maxK, nil)
+	if err := readSections(r, e); err != nil {
+		return nil, err
+	}
+	e.mmapData = data
+	return e, nil
+}
+
+// parseMmapLshForest parses an LSH Forest written by LshForest.write
+// starting at the current position of r, which reads from data.
+// The hash tables are referenced in data rather than copied.
+func parseMmapLshForest[K comparable](r *bytes.Reader, data []byte) (*MmapLshForestOf[K], error) {
+	header, err := readUints(r, 5)
+	if err != nil {
+		return nil, err
+	}
+	if !validForestHeader(header) {
+		return nil, errForestHeader
+	}
+	k, l, hashValueBits := int(header[0]), int(header[1]), int(header[2])
+	numIndexedKeys, numEntries := int(header[3]), int(header[4])
+	keys, err := readKeys[K](r)
+	if err != nil {
+		return nil, err
+	}
+	// The released IDs are not needed by the read-only forest.
+	if _, err := readKeys[uint32](r); err != nil {
+		return nil, err
+	}
+	tombstones, err := readKeys[uint32](r)
+	if err != nil {
+		return nil, err
+	}
+	offset := len(data) - r.Len()
+	// Each factor is checked so the size cannot overflow.
+	entrySize := hashKeySize(k, hashValueBits) + 4
+	if l > r.Len() || numEntries > r.Len() ||
+		(l > 0 && numEntries > r.Len()/entrySize/l) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := l * numEntries * entrySize
+	if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil {
+		return nil, err
+	}
+	tables := data[offset : offset+size]
+	// The IDs are validated once, so queries can use them as they are.
+	for j := entrySize - 4; j < size; j += entrySize {
+		if int(binary.LittleEndian.Uint32(tables[j:])) >= len(keys) {
+			return nil, errForestEntry
+		}
+	}
+	f := &MmapLshForestOf[K]{
+		k:              k,
+		l:              l,
+		hashValueBits:  hashValueBits,
+		numIndexedKeys: numIndexedKeys,
+		numEntries:     numEntries,
+		keys:           keys,
+		tombstones:     keySet(tombstones),
+		tables:         tables,
+		hashKeyFunc:    hashKeyFuncGen(hashValueBits),
+	}
+	if l > 0 {
+		searchable := make([]bool, len(keys))
+		for j := 0; j < numIndexedKeys; j++ {
+			id := binary.LittleEndian.Uint32(tables[(j+1)*entrySize-4:])
+			if !searchable[id] && !f.tombstones[id] {
+				searchable[id] = true
+				f.numSearchable++
+			}
+		}
+	}
+	return f, nil
+}
+
+// Close releases the memory mapping of the forest.
+func (f *MmapLshForestOf[K]) Close() error {
+	data := f.data
+	f.data = nil
+	return munmapFile(data)
+}
+
+// Add is not supported by the read-only MmapLshForestOf and panics.
+func (f *MmapLshForestOf[K]) Add(key K, sig []uint64) {
+	panic("MmapLshForest is read-only")
+}
+
+// Remove is not supported by the read-only MmapLshForestOf and panics.
+func (f *MmapLshForestOf[K]) Remove(key K) {
+	panic("MmapLshForest is read-only")
+}
+
+// Index does nothing, as all keys in the file are already indexed.
+func (f *MmapLshForestOf[K]) Index() {}
+
+// Query returns candidate keys given the query signature and parameters.
+func (f *MmapLshForestOf[K]) Query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) {
+	f.query(sig, k, l, out, done)
+}
+
+// query is the same as Query, and returns true if it is stopped by
+// closing done.
+func (f *MmapLshForestOf[K]) query(sig []uint64, k, l int, out chan<- K, done <-chan struct{}) bool {
+	if k == -1 {
+		k = f.k
+	}
+	if l == -1 {
+		l = f.l
+	}
+	prefixBits := f.hashValueBits * k
+	entrySize := hashKeySize(f.k, f.hashValueBits) + 4
+	tableSize := f.numEntries * entrySize
+	seens := make(map[uint32]bool)
+	for i := 0; i < l; i++ {
+		// Only search over indexed keys.
+		ht := f.tables[i*tableSize : i*tableSize+f.numIndexedKeys*entrySize]
+		hk := []byte(f.hashKeyFunc(sig[i*f.k : i*f.k+k]))
+		hashKey := func(x int) []byte {
+			return ht[x*entrySize : (x+1)*entrySize-4]
+		}
+		start := sort.Search(f.numIndexedKeys, func(x int) bool {
+			return comparePrefix(hashKey(x), hk, prefixBits) >= 0
+		})
+		for j := start; j < f.numIndexedKeys && comparePrefix(hashKey(j), hk, prefixBits) == 0; j++ {
+			id := binary.LittleEndian.Uint32(ht[(j+1)*entrySize-4:])
+			if _, seen := seens[id]; seen {
+				continue
+			}
+			seens[id] = true
+			if f.tombstones[id] {
+				continue
+			}
+			select {
+			case out <- f.keys[id]:
+			case <-done:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numKeys returns the number of searchable keys, which have been
+// indexed and not removed.
+func (f *MmapLshForestOf[K]) numKeys() int {
+	return f.numSearchable
+}
+
+// QueryContext returns candidate keys given the query signature and parameters,
+// and stops when ctx is done, returning the context error.
+func (f *MmapLshForestOf[K]) QueryContext(ctx context.Context, sig []uint64, k, l int, out chan<- K) error {
+	if f.query(sig, k, l, out, ctx.Done()) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// OptimalKL returns the optimal K and L for containment search,
+// and the false positive and negative probabilities.
+// where x is the indexed domain size, q is the query domain size,
+// and t is the containment threshold.
+func (f *MmapLshForestOf[K]) OptimalKL(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return f.optimalKL(containmentMeasure, x, q, t, Objective{}, defaultIntegrationTolerance)
+}
+
+// OptimalKLJaccard returns the optimal K and L for Jaccard similarity
+// search, and the false positive and negative probabilities.
+// where x is the indexed domain size, q is the query domain size,
+// and t is the Jaccard similarity threshold.
+func (f *MmapLshForestOf[K]) OptimalKLJaccard(x, q int, t float64) (optK, optL int, fp, fn float64) {
+	return f.optimalKL(jaccardMeasure, x, q, t, Objective{}, defaultIntegrationTolerance)
+}
+
+// optimalKL returns the optimal K and L under the objective for
+// the similarity measure m, integrating the probabilities with the
+// absolute error tolerance.
+func (f *MmapLshForestOf[K]) optimalKL(m measure, x, q int, t float64, obj Objective, tolerance float64) (optK, optL int, fp, fn float64) {
+	return forestOptimalKL(f.k, f.l, measureProbs(m, x, q, f.hashValueBits, t, tolerance), obj)
+}
+
+// validKL returns true if queries of the parameters K and L are
+// supported by the forest.
+func (f *MmapLshForestOf[K]) validKL(k, l int) bool {
+	return k >= 1 && k <= f.k && l >= 1 && l <= f.l
+}
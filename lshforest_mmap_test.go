@@ -0,0 +1,188 @@
+package lshensemble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_MmapLshForest(t *testing.T) {
+	f := NewLshForest16(2, 4, 3)
+	sig1 := randomSignature(8, 2)
+	sig2 := randomSignature(8, 1)
+	sig3 := randomSignature(8, 1)
+	f.Add("sig1", sig1)
+	f.Add("sig2", sig2)
+	f.Add("sig3", sig3)
+	f.Index()
+
+	path := filepath.Join(t.TempDir(), "forest")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	m, err := OpenMmapLshForest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	keys := make(chan interface{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		m.Query(sig3, 1, 4, keys, done)
+		close(keys)
+	}()
+	found := 0
+	for key := range keys {
+		if key == "sig2" || key == "sig3" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatal("unable to retrieve inserted keys")
+	}
+}
+
+func Test_MmapLshEnsemble(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	mapped, err := OpenMmapLshEnsemble(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+	expected := queryAll(index, recs, 0.5)
+	actual := queryAll(mapped, recs, 0.5)
+	for i := range expected {
+		if !sameKeys(expected[i], actual[i]) {
+			t.Fatalf("query results mismatch %v, %v", expected[i], actual[i])
+		}
+	}
+
+	// Indexes of LshForestArray cannot be memory mapped.
+	plus, err := BootstrapLshEnsemblePlusOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plus.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if _, err := OpenMmapLshEnsemble(path); err != errLshKind {
+		t.Fatal("expecting unsupported Lsh error, got", err)
+	}
+}
+
+func Test_MmapLshForestBits(t *testing.T) {
+	f := NewLshForestBits(4, 8, 2, 100)
+	for i := 0; i < 100; i++ {
+		f.Add(i, randomSignature(32, int64(i)))
+	}
+	f.Index()
+	path := filepath.Join(t.TempDir(), "forest")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	m, err := OpenMmapLshForest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	query := func(lsh Lsh, sig []uint64, k int) []interface{} {
+		out := make(chan interface{})
+		go func() {
+			lsh.Query(sig, k, -1, out, nil)
+			close(out)
+		}()
+		var keys []interface{}
+		for key := range out {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	if numKeys := m.numKeys(); numKeys != 100 {
+		t.Fatalf("Expected 100 keys, got %d", numKeys)
+	}
+	for k := 1; k <= 4; k++ {
+		sig := randomSignature(32, 7)
+		expected, actual := query(f, sig, k), query(m, sig, k)
+		if !sameKeys(expected, actual) {
+			t.Fatalf("k = %d: query results mismatch %v, %v", k, expected, actual)
+		}
+	}
+}
+
+func Test_MmapLshForestCorrupted(t *testing.T) {
+	f := NewLshForest16(2, 4, 3)
+	f.Add("sig1", randomSignature(8, 1))
+	f.Add("sig2", randomSignature(8, 2))
+	f.Index()
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "forest")
+	open := func(data []byte) error {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := OpenMmapLshForest(path)
+		if err == nil {
+			m.Close()
+		}
+		return err
+	}
+	// The file ends with the ID of the last hash table entry.
+	data := append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], math.MaxUint32)
+	if err := open(data); err != errForestEntry {
+		t.Fatal("expecting corrupted entry error, got", err)
+	}
+	// The number of entries follows the magic number, the version, k, l,
+	// the hash value width and the number of indexed entries.
+	data = append([]byte(nil), buf.Bytes()...)
+	binary.LittleEndian.PutUint64(data[len(forestMagic)+40:], math.MaxInt32)
+	binary.LittleEndian.PutUint64(data[len(forestMagic)+32:], 0)
+	if err := open(data); err != io.ErrUnexpectedEOF {
+		t.Fatal("expecting unexpected EOF error, got", err)
+	}
+	binary.LittleEndian.PutUint64(data[len(forestMagic)+40:], math.MaxUint64)
+	if err := open(data); err != errForestHeader {
+		t.Fatal("expecting corrupted parameters error, got", err)
+	}
+}
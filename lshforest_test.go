@@ -1,7 +1,9 @@
 package lshensemble
 
 import (
+	"bytes"
 	"math/rand"
+	"strconv"
 	"testing"
 )
 
@@ -16,7 +18,7 @@ func randomSignature(size int, seed int64) []uint64 {
 
 func Test_HashKeyFunc16(t *testing.T) {
 	sig := randomSignature(2, 1)
-	f := hashKeyFuncGen(2)
+	f := hashKeyFuncGen(16)
 	hashKey := f(sig)
 	if len(hashKey) != 2*2 {
 		t.Fatal(len(hashKey))
@@ -25,13 +27,98 @@ func Test_HashKeyFunc16(t *testing.T) {
 
 func Test_HashKeyFunc64(t *testing.T) {
 	sig := randomSignature(2, 1)
-	f := hashKeyFuncGen(8)
+	f := hashKeyFuncGen(64)
 	hashKey := f(sig)
 	if len(hashKey) != 8*2 {
 		t.Fatal(len(hashKey))
 	}
 }
 
+func Test_HashKeyFuncBits(t *testing.T) {
+	sig := []uint64{0x5, 0x2, 0x7, 0x1}
+	hashKey := hashKeyFuncGen(3)(sig)
+	// 101 010 111 001 packed from the most significant bit.
+	if hashKey != string([]byte{0xab, 0x90}) {
+		t.Fatalf("%x", hashKey)
+	}
+	for _, bits := range []int{1, 2, 4, 8} {
+		f := hashKeyFuncGen(bits)
+		sig := randomSignature(7, int64(bits))
+		full := []byte(f(sig))
+		if len(full) != hashKeySize(7, bits) {
+			t.Fatalf("%d bits: hash key size %d", bits, len(full))
+		}
+		for k := 1; k <= len(sig); k++ {
+			prefix := []byte(f(sig[:k]))
+			if comparePrefix(full, prefix, k*bits) != 0 {
+				t.Errorf("%d bits: hash key of %d values is not a prefix", bits, k)
+			}
+		}
+	}
+}
+
+func Test_LshForestBits(t *testing.T) {
+	numHash, numKeys := 32, 200
+	for _, bits := range []int{1, 2, 8, 16} {
+		f := NewLshForestBits(4, numHash/4, bits, numKeys)
+		sigs := make([][]uint64, numKeys)
+		for i := range sigs {
+			sigs[i] = randomSignature(numHash, int64(i))
+			f.Add(i, sigs[i])
+		}
+		f.Index()
+		// Compare with the keys whose trimmed hash values match.
+		mask := uint64(1)<<bits - 1
+		for _, k := range []int{1, 3, 4} {
+			query := sigs[0]
+			expected := make(map[interface{}]bool)
+			for i, sig := range sigs {
+				for b := 0; b < numHash/4; b++ {
+					match := true
+					for j := b * 4; j < b*4+k; j++ {
+						match = match && sig[j]&mask == query[j]&mask
+					}
+					if match {
+						expected[i] = true
+						break
+					}
+				}
+			}
+			out := make(chan interface{})
+			go func() {
+				f.Query(query, k, -1, out, nil)
+				close(out)
+			}()
+			found := make(map[interface{}]bool)
+			for key := range out {
+				found[key] = true
+			}
+			if len(found) != len(expected) {
+				t.Fatalf("%d bits, k = %d: expected %d candidates, got %d",
+					bits, k, len(expected), len(found))
+			}
+			for key := range expected {
+				if !found[key] {
+					t.Fatalf("%d bits, k = %d: missing candidate %v", bits, k, key)
+				}
+			}
+		}
+	}
+}
+
+func Test_LshForestBitsInvalid(t *testing.T) {
+	for _, bits := range []int{0, 9, 12, 72} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%d bits: expected panic", bits)
+				}
+			}()
+			NewLshForestBits(2, 4, bits, 1)
+		}()
+	}
+}
+
 func Test_LshForest(t *testing.T) {
 	f := NewLshForest16(2, 4, 3)
 	sig1 := randomSignature(8, 2)
@@ -44,7 +131,7 @@ func Test_LshForest(t *testing.T) {
 
 	f.Index()
 	for i := range f.hashTables {
-		if len(f.hashTables[i]) != 3 {
+		if f.hashTables[i].Len() != 3 {
 			t.Fatal(f.hashTables[i])
 		}
 	}
@@ -71,3 +158,220 @@ func Test_LshForest_OptimalKL(t *testing.T) {
 	f := NewLshForest16(2, 32, 1)
 	t.Log(f.OptimalKL(32, 12, 0.5))
 }
+
+func Test_LshForest_OptimalKLBits(t *testing.T) {
+	_, _, fp64, _ := NewLshForest64(4, 32, 1).OptimalKL(100, 100, 0.5)
+	k, _, fp1, _ := NewLshForestBits(4, 32, 1, 1).OptimalKL(100, 100, 0.5)
+	if fp1 <= fp64 {
+		t.Errorf("1-bit hash values expected more false positives, %f <= %f", fp1, fp64)
+	}
+	// More hash values per band compensate for the accidental collisions.
+	if k64, _, _, _ := NewLshForest64(4, 32, 1).OptimalKL(100, 100, 0.5); k < k64 {
+		t.Errorf("1-bit hash values expected larger K, %d < %d", k, k64)
+	}
+}
+
+func Test_LshForestRemove(t *testing.T) {
+	f := NewLshForest16(2, 4, 3)
+	sig1 := randomSignature(8, 1)
+	sig2 := randomSignature(8, 1)
+	f.Add("sig1", sig1)
+	f.Add("sig2", sig2)
+	f.Index()
+	f.Remove("sig1")
+	// Removing a key not yet indexed deletes its entries directly.
+	f.Add("sig3", sig1)
+	f.Remove("sig3")
+	for i := range f.hashTables {
+		if f.hashTables[i].Len() != 2 {
+			t.Fatal(f.hashTables[i])
+		}
+	}
+	query := func() map[interface{}]bool {
+		keys := make(chan interface{})
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			f.Query(sig1, 2, 4, keys, done)
+			close(keys)
+		}()
+		found := make(map[interface{}]bool)
+		for key := range keys {
+			found[key] = true
+		}
+		return found
+	}
+	if found := query(); found["sig1"] || !found["sig2"] {
+		t.Fatal("removed key returned before compaction", found)
+	}
+	// Re-adding a removed key makes it searchable after Index().
+	f.Add("sig1", sig1)
+	if found := query(); found["sig1"] {
+		t.Fatal("key returned before Index()", found)
+	}
+	f.Index()
+	for i := range f.hashTables {
+		if f.hashTables[i].Len() != 2 {
+			t.Fatal(f.hashTables[i])
+		}
+	}
+	if found := query(); !found["sig1"] || !found["sig2"] {
+		t.Fatal("unable to retrieve re-added key", found)
+	}
+}
+
+func Test_LshForestIndexBatches(t *testing.T) {
+	numHash, numKeys := 16, 300
+	f := NewLshForest16(2, 8, 0)
+	sigs := make([][]uint64, numKeys)
+	for i := range sigs {
+		sigs[i] = randomSignature(numHash, int64(i))
+	}
+	// Index the keys in batches, removing some of the indexed keys in
+	// between, so the added entries are merged into the sorted tables.
+	for start := 0; start < numKeys; start += 50 {
+		for i := start; i < start+50; i++ {
+			f.Add(strconv.Itoa(i), sigs[i])
+		}
+		if start > 0 {
+			f.Remove(strconv.Itoa(start - 1))
+		}
+		f.Index()
+		if expected := start + 50 - start/50; f.numKeys() != expected {
+			t.Fatalf("Expected %d searchable keys, got %d", expected, f.numKeys())
+		}
+		for i := range f.hashTables {
+			ht := &f.hashTables[i]
+			for j := 1; j < ht.Len(); j++ {
+				if ht.Less(j, j-1) {
+					t.Fatalf("Hash table %d is not sorted after indexing %d keys", i, start+50)
+				}
+			}
+		}
+	}
+	for i := 0; i < numKeys; i++ {
+		removed := (i+1)%50 == 0 && i < numKeys-1
+		keys := make(chan interface{})
+		go func() {
+			f.Query(sigs[i], -1, -1, keys, nil)
+			close(keys)
+		}()
+		var found bool
+		for key := range keys {
+			if key == strconv.Itoa(i) {
+				found = true
+			}
+		}
+		if found == removed {
+			t.Errorf("Query key %d: found %v, removed %v", i, found, removed)
+		}
+	}
+	// The number of searchable keys is restored when loaded.
+	f.Remove("0")
+	var buf bytes.Buffer
+	if err := f.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readLshForest[interface{}](&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.numKeys() != f.numKeys() {
+		t.Errorf("Expected %d searchable keys after loading, got %d", f.numKeys(), loaded.numKeys())
+	}
+}
+
+func Test_LshForestInternKeys(t *testing.T) {
+	f := NewLshForest16Of[string](2, 4, 3)
+	f.Add("sig1", randomSignature(8, 1))
+	f.Add("sig2", randomSignature(8, 2))
+	f.Index()
+	if len(f.keys) != 2 || f.ids["sig1"] != 0 || f.ids["sig2"] != 1 {
+		t.Fatal("keys not interned", f.keys, f.ids)
+	}
+	f.Remove("sig1")
+	f.Index()
+	if _, exists := f.ids["sig1"]; exists || len(f.freeIDs) != 1 {
+		t.Fatal("ID of removed key not released", f.ids, f.freeIDs)
+	}
+	// The released ID is reused by the next new key.
+	sig3 := randomSignature(8, 3)
+	f.Add("sig3", sig3)
+	f.Index()
+	if len(f.keys) != 2 || f.ids["sig3"] != 0 || len(f.freeIDs) != 0 {
+		t.Fatal("released ID not reused", f.keys, f.ids, f.freeIDs)
+	}
+	keys := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		f.Query(sig3, 2, 4, keys, done)
+		close(keys)
+	}()
+	var found bool
+	for key := range keys {
+		if key == "sig1" {
+			t.Fatal("removed key returned")
+		}
+		if key == "sig3" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("unable to retrieve inserted key")
+	}
+}
+
+func Test_LshForestArrayInternKeys(t *testing.T) {
+	a := NewLshForestArrayOf[string](4, 16, 0)
+	a.Add("sig1", randomSignature(16, 1))
+	a.Add("sig2", randomSignature(16, 2))
+	a.Index()
+	for _, f := range a.array {
+		if f.keyTable != a.array[0].keyTable {
+			t.Fatal("key table not shared by the forests")
+		}
+	}
+	if len(a.array[0].keys) != 2 {
+		t.Fatal("keys not interned once", a.array[0].keys)
+	}
+	a.Remove("sig1")
+	a.Index()
+	if len(a.array[0].freeIDs) != 1 {
+		t.Fatal("ID of removed key not released once", a.array[0].freeIDs)
+	}
+	c := a.clone().(*LshForestArrayOf[string])
+	if c.array[1].keyTable != c.array[0].keyTable || c.array[0].keyTable == a.array[0].keyTable {
+		t.Fatal("key table of the clone not copied and shared")
+	}
+}
+
+func Test_LshForestInternKeysOverflow(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("slices cannot hold 2^32 keys")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expecting panic interning more than 2^32 keys")
+		}
+	}()
+	table := newKeyTable[struct{}](0)
+	table.keys = make([]struct{}, uint64(1)<<32)
+	table.intern(struct{}{})
+}
+
+func Test_LshForest_OptimalKLJaccard(t *testing.T) {
+	f := NewLshForest64(4, 32, 1)
+	k, l, fp, fn := f.OptimalKLJaccard(100, 100, 0.8)
+	if k < 1 || k > 4 || l < 1 || l > 32 || fp < 0 || fn < 0 || fp+fn > 0.2 {
+		t.Fatalf("Unexpected parameters k = %d, l = %d, fp = %f, fn = %f", k, l, fp, fn)
+	}
+	// Indexed domains much smaller than the query cannot reach the threshold.
+	if _, _, _, fn := f.OptimalKLJaccard(10, 100, 0.5); fn != 0 {
+		t.Errorf("Expected no false negatives, got %f", fn)
+	}
+	// A stricter threshold needs larger K.
+	if k5, _, _, _ := f.OptimalKLJaccard(100, 100, 0.5); k5 > k {
+		t.Errorf("Expected K no greater than %d for a lower threshold, got %d", k, k5)
+	}
+}
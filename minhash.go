@@ -3,55 +3,291 @@ package lshensemble
 import (
 	"bytes"
 	"encoding/binary"
-	"hash/fnv"
+	"errors"
+	"math"
 	"math/rand"
-
-	minwise "github.com/dgryski/go-minhash"
+	"runtime"
+	"sync"
 )
 
 // HashValueSize is 8, the number of byte used for each hash value
 const HashValueSize = 8
 
+// maxHashValue is the hash value of an empty signature.
+const maxHashValue = math.MaxUint64
+
+// sketch is the state of a MinHash object, which is updated by the
+// pushed values and produces the signature.
+type sketch interface {
+	Push(b []byte)
+	Signature() []uint64
+}
+
+// sketchKind identifies the sketch of a Minhash in its binary form.
+type sketchKind byte
+
+const (
+	sketchMinWise        sketchKind = 1
+	sketchOnePermutation sketchKind = 2
+	sketchUniversal      sketchKind = 3
+	sketchWeighted       sketchKind = 4
+)
+
+// minhashFormatVersion is the version of the binary form of Minhash.
+// One-permutation sketches of version 1 are not finalized by SplitMix64,
+// and cannot be restored. Versions 1 and 2 have no hash family, which
+// is FNV64a.
+const minhashFormatVersion = 3
+
+var (
+	errMinhashMismatch = errors.New("Minhash objects must have the same seed, number of hash functions, type and hash family")
+	errMinhashData     = errors.New("Invalid Minhash binary data")
+	errWeightedOverlap = errors.New("Weighted Minhash objects to merge must not have the same values")
+)
+
 // Minhash represents a MinHash object
 type Minhash struct {
-	mw *minwise.MinWise
+	seed    int64
+	numHash int
+	kind    sketchKind
+	family  HashFamily
+	sk      sketch
 }
 
 // NewMinhash initializes a MinHash object with a seed and the number of
 // hash functions.
-func NewMinhash(seed int64, numHash int) *Minhash {
+// opts are the options to choose the hash family and permutation scheme.
+func NewMinhash(seed int64, numHash int, opts ...MinhashOption) *Minhash {
+	c := newMinhashConfig(opts)
+	kind := sketchMinWise
+	if c.scheme == UniversalPermutations {
+		kind = sketchUniversal
+	}
+	return newMinhash(seed, numHash, kind, c.family)
+}
+
+// newMinhash initializes a MinHash object using the sketch kind and the
+// hash family.
+func newMinhash(seed int64, numHash int, kind sketchKind, family HashFamily) *Minhash {
 	r := rand.New(rand.NewSource(seed))
-	b := binary.BigEndian
-	b1 := make([]byte, HashValueSize)
-	b2 := make([]byte, HashValueSize)
-	b.PutUint64(b1, uint64(r.Int63()))
-	b.PutUint64(b2, uint64(r.Int63()))
-	fnv1 := fnv.New64a()
-	fnv2 := fnv.New64a()
-	h1 := func(b []byte) uint64 {
-		fnv1.Reset()
-		fnv1.Write(b1)
-		fnv1.Write(b)
-		return fnv1.Sum64()
-	}
-	h2 := func(b []byte) uint64 {
-		fnv2.Reset()
-		fnv2.Write(b2)
-		fnv2.Write(b)
-		return fnv2.Sum64()
-	}
-	return &Minhash{minwise.NewMinWise(h1, h2, numHash)}
+	m := &Minhash{seed: seed, numHash: numHash, kind: kind, family: family}
+	switch kind {
+	case sketchOnePermutation:
+		m.sk = newOnePermutation(r, family, numHash)
+	case sketchUniversal:
+		m.sk = newUniversalMinWise(r, family, numHash)
+	case sketchWeighted:
+		m.sk = newWeightedMinWise(r, family, numHash)
+	default:
+		h1, h2 := seededHashes(r, family)
+		m.sk = newMinWise(h1, h2, numHash)
+	}
+	return m
+}
+
+// NewMinhashFromSignature initializes a MinHash object with a seed and
+// the signature of a MinHash object created by NewMinhash with the same
+// seed and options, so more values can be pushed to it, or it can be
+// merged with other MinHash objects.
+func NewMinhashFromSignature(seed int64, sig []uint64, opts ...MinhashOption) *Minhash {
+	m := NewMinhash(seed, len(sig), opts...)
+	m.setMinimums(sig)
+	return m
+}
+
+// setMinimums replaces the minimum hash values of a sketch using the
+// universal permutations or the hash functions h1 + i*h2 by a copy of sig.
+func (m *Minhash) setMinimums(sig []uint64) {
+	minimums := append([]uint64(nil), sig...)
+	switch sk := m.sk.(type) {
+	case *minWise:
+		sk.minimums = minimums
+	case *universalMinWise:
+		sk.minimums = minimums
+	}
+}
+
+// Compatible returns true if the signatures of the MinHash object and
+// other can be compared or merged, i.e., they are created by the same
+// constructor with the same seed, number of hash functions and options.
+func (m *Minhash) Compatible(other *Minhash) bool {
+	return m.seed == other.seed && m.numHash == other.numHash &&
+		m.kind == other.kind && m.family == other.family
 }
 
 // Push a new value to the MinHash object.
 // The value should be serialized to byte slice.
 func (m *Minhash) Push(b []byte) {
-	m.mw.Push(b)
+	m.sk.Push(b)
+}
+
+// PushBatch pushes a batch of values to the MinHash object.
+func (m *Minhash) PushBatch(values [][]byte) {
+	for _, b := range values {
+		m.sk.Push(b)
+	}
+}
+
+// PushParallel pushes values to the MinHash object using numWorkers
+// goroutines, each pushing a shard of the values to its own MinHash
+// object, which are then merged.
+// The signature is identical to the one of pushing the values sequentially.
+// If numWorkers is not positive, runtime.NumCPU() is used.
+// For a weighted MinHash object, an error is returned if a value is found
+// in more than one shard or already pushed, as Merge does, and m is then
+// unchanged.
+func (m *Minhash) PushParallel(values [][]byte, numWorkers int) error {
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	if numWorkers > len(values) {
+		numWorkers = len(values)
+	}
+	if numWorkers <= 1 {
+		m.PushBatch(values)
+		return nil
+	}
+	workers := make([]*Minhash, numWorkers)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := range workers {
+		workers[i] = m.empty()
+		start, end := i*len(values)/numWorkers, (i+1)*len(values)/numWorkers
+		go func(w *Minhash, shard [][]byte) {
+			w.PushBatch(shard)
+			wg.Done()
+		}(workers[i], values[start:end])
+	}
+	wg.Wait()
+	// The shards are merged into the first one before m, so m is not
+	// changed by a failed merge.
+	for _, w := range workers[1:] {
+		if err := workers[0].Merge(w); err != nil {
+			return err
+		}
+	}
+	return m.Merge(workers[0])
+}
+
+// empty returns a new MinHash object created by the same constructor
+// with the same seed, number of hash functions and options.
+func (m *Minhash) empty() *Minhash {
+	return newMinhash(m.seed, m.numHash, m.kind, m.family)
 }
 
 // Signature exports the MinHash signature.
 func (m *Minhash) Signature() []uint64 {
-	return m.mw.Signature()
+	return m.sk.Signature()
+}
+
+// Merge updates the MinHash object to the MinHash of the union of its
+// values and the values of other, which must be created by the same
+// constructor with the same seed, number of hash functions and options.
+// As every distinct value must be pushed to a weighted MinHash object only
+// once, weighted MinHash objects must have disjoint values, so their total
+// weights and numbers of values are added. An error is returned if a value
+// is found to be pushed to both, and m is then unchanged.
+func (m *Minhash) Merge(other *Minhash) error {
+	if !m.Compatible(other) {
+		return errMinhashMismatch
+	}
+	if w, ok := m.sk.(*weightedMinWise); ok && w.overlaps(other.sk.(*weightedMinWise)) {
+		return errWeightedOverlap
+	}
+	switch sk := m.sk.(type) {
+	case *minWise:
+		sk.merge(other.sk.(*minWise))
+	case *universalMinWise:
+		sk.merge(other.sk.(*universalMinWise))
+	case *onePermutation:
+		sk.merge(other.sk.(*onePermutation))
+	case *weightedMinWise:
+		sk.merge(other.sk.(*weightedMinWise))
+	}
+	return nil
+}
+
+// MarshalBinary encodes the MinHash object including its seed, number
+// of hash functions and options, so it keeps accepting new values once
+// restored using UnmarshalBinary.
+func (m *Minhash) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(minhashFormatVersion)
+	buf.WriteByte(byte(m.kind))
+	buf.WriteByte(byte(m.family))
+	binary.Write(buf, binary.BigEndian, m.seed)
+	binary.Write(buf, binary.BigEndian, uint64(m.numHash))
+	switch sk := m.sk.(type) {
+	case *onePermutation:
+		buf.Write(SigToBytes(sk.bins))
+		for _, filled := range sk.filled {
+			if filled {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		}
+	case *weightedMinWise:
+		buf.Write(SigToBytes(sk.samples))
+		buf.Write(sk.marshal())
+	default:
+		buf.Write(SigToBytes(sk.Signature()))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores a MinHash object encoded by MarshalBinary,
+// replacing the content of m.
+func (m *Minhash) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] < 1 || data[0] > minhashFormatVersion {
+		return errMinhashData
+	}
+	version, kind := data[0], sketchKind(data[1])
+	data = data[2:]
+	family := FNV64a
+	if version >= 3 && len(data) > 0 {
+		family = HashFamily(data[0])
+		data = data[1:]
+	}
+	if len(data) < 2*HashValueSize || family > SipHash {
+		return errMinhashData
+	}
+	seed := int64(binary.BigEndian.Uint64(data))
+	numHash := binary.BigEndian.Uint64(data[HashValueSize:])
+	data = data[2*HashValueSize:]
+	if numHash > uint64(len(data)/HashValueSize) {
+		return errMinhashData
+	}
+	values, _ := BytesToSig(data[:numHash*HashValueSize])
+	data = data[numHash*HashValueSize:]
+	var restored *Minhash
+	switch kind {
+	case sketchMinWise, sketchUniversal:
+		if len(data) != 0 {
+			return errMinhashData
+		}
+		restored = newMinhash(seed, int(numHash), kind, family)
+		restored.setMinimums(values)
+	case sketchOnePermutation:
+		if version < 2 || uint64(len(data)) != numHash {
+			return errMinhashData
+		}
+		restored = newMinhash(seed, int(numHash), kind, family)
+		o := restored.sk.(*onePermutation)
+		copy(o.bins, values)
+		for i, filled := range data {
+			o.filled[i] = filled == 1
+		}
+	case sketchWeighted:
+		restored = newMinhash(seed, int(numHash), kind, family)
+		if err := restored.sk.(*weightedMinWise).unmarshal(values, data); err != nil {
+			return err
+		}
+	default:
+		return errMinhashData
+	}
+	*m = *restored
+	return nil
 }
 
 // Containment returns the estimated containment of
@@ -62,14 +298,25 @@ func Containment(q, x []uint64, qSize, xSize int) float64 {
 	if qSize == 0 || xSize == 0 {
 		return 0.0
 	}
+	return containment(similarityOf(q, x), float64(xSize)/float64(qSize))
+}
+
+// similarityOf returns the fraction of equal hash values of two
+// signatures, which is the estimated Jaccard similarity.
+func similarityOf(q, x []uint64) float64 {
 	var eq int
 	for i, hv := range q {
 		if x[i] == hv {
 			eq++
 		}
 	}
-	jaccard := float64(eq) / float64(len(q))
-	c := (float64(xSize)/float64(qSize) + 1.0) * jaccard / (1.0 + jaccard)
+	return float64(eq) / float64(len(q))
+}
+
+// containment converts the Jaccard similarity of Q and X into the
+// containment of Q in X, given the ratio of the size of X to the size of Q.
+func containment(jaccard, ratio float64) float64 {
+	c := (ratio + 1.0) * jaccard / (1.0 + jaccard)
 	if c > 1.0 {
 		return 1.0
 	}
@@ -11,6 +11,69 @@ func TestMinhash(t *testing.T) {
 	m.Push([]byte("Test some input"))
 }
 
+// similarity returns the fraction of equal hash values of two signatures,
+// which estimates the Jaccard similarity.
+func similarity(sig1, sig2 []uint64) float64 {
+	var eq int
+	for i := range sig1 {
+		if sig1[i] == sig2[i] {
+			eq++
+		}
+	}
+	return float64(eq) / float64(len(sig1))
+}
+
+func TestOnePermutationMinhash(t *testing.T) {
+	d := data(10000)
+	m1 := NewOnePermutationMinhash(1, 256)
+	m2 := NewOnePermutationMinhash(1, 256)
+	hashing(m1, 0, 6500, d)
+	hashing(m2, 3500, 10000, d)
+	sig1, sig2 := m1.Signature(), m2.Signature()
+	if len(sig1) != 256 {
+		t.Fatalf("Expected signature of 256 hash values, got %d", len(sig1))
+	}
+	act := 3000.0 / 10000.0
+	if est := similarity(sig1, sig2); math.Abs(est-act) > 0.1 {
+		t.Errorf("Expected similarity close to %f, got %f", act, est)
+	}
+	// The same values produce the same signature.
+	m3 := NewOnePermutationMinhash(1, 256)
+	hashing(m3, 0, 6500, d)
+	if similarity(sig1, m3.Signature()) != 1.0 {
+		t.Error("Signatures of the same values are different")
+	}
+}
+
+func TestOnePermutationMinhashDensification(t *testing.T) {
+	d := data(10)
+	m1 := NewOnePermutationMinhash(1, 256)
+	m2 := NewOnePermutationMinhash(1, 256)
+	hashing(m1, 0, 10, d)
+	hashing(m2, 0, 10, d)
+	sig := m1.Signature()
+	for i, hv := range sig {
+		if hv == math.MaxUint64 {
+			t.Fatalf("Bin %d is not densified", i)
+		}
+	}
+	if similarity(sig, m2.Signature()) != 1.0 {
+		t.Error("Densified signatures of the same values are different")
+	}
+	// Signatures of disjoint sets must have few equal hash values.
+	m3 := NewOnePermutationMinhash(1, 256)
+	hashing(m3, 0, 10, data(20)[10:])
+	if est := similarity(sig, m3.Signature()); est > 0.1 {
+		t.Errorf("Expected similarity close to 0 for disjoint sets, got %f", est)
+	}
+	// An empty sketch has the signature of an empty MinHash.
+	for _, hv := range NewOnePermutationMinhash(1, 16).Signature() {
+		if hv != math.MaxUint64 {
+			t.Fatal("Expected maximum hash values for empty signature")
+		}
+	}
+}
+
 func data(size int) [][]byte {
 	d := make([][]byte, size)
 	for i := range d {
@@ -43,7 +106,7 @@ func benchmark(minhashSize, dataSize int, t *testing.B) {
 	hashing(m1, a_start, a_end, d)
 	hashing(m2, b_start, b_end, d)
 
-	est := m1.mw.Similarity(m2.mw)
+	est := similarity(m1.Signature(), m2.Signature())
 	act := float64(a_end-b_start) / float64(b_end-a_start)
 	err := math.Abs(act - est)
 	fmt.Printf("Data size: %8d, ", dataSize)
@@ -52,6 +115,195 @@ func benchmark(minhashSize, dataSize int, t *testing.B) {
 	fmt.Printf("Absolute Error: %.8f\n", err)
 }
 
+func sameSignature(sig1, sig2 []uint64) bool {
+	return len(sig1) == len(sig2) && similarity(sig1, sig2) == 1.0
+}
+
+func TestMinhashMerge(t *testing.T) {
+	d := data(1000)
+	for _, newMinhash := range []func(int64, int, ...MinhashOption) *Minhash{NewMinhash, NewOnePermutationMinhash} {
+		all := newMinhash(1, 128)
+		hashing(all, 0, 1000, d)
+		m1 := newMinhash(1, 128)
+		m2 := newMinhash(1, 128)
+		hashing(m1, 0, 400, d)
+		hashing(m2, 400, 1000, d)
+		if err := m1.Merge(m2); err != nil {
+			t.Fatal(err)
+		}
+		if !sameSignature(m1.Signature(), all.Signature()) {
+			t.Error("Merged signature is different from the signature of the union")
+		}
+		if err := m1.Merge(newMinhash(2, 128)); err == nil {
+			t.Error("Expected error merging Minhash with different seeds")
+		}
+		if err := m1.Merge(newMinhash(1, 64)); err == nil {
+			t.Error("Expected error merging Minhash with different number of hash functions")
+		}
+	}
+	if err := NewMinhash(1, 128).Merge(NewOnePermutationMinhash(1, 128)); err == nil {
+		t.Error("Expected error merging Minhash of different types")
+	}
+}
+
+func TestNewMinhashFromSignature(t *testing.T) {
+	d := data(1000)
+	for _, opts := range [][]MinhashOption{nil, {WithPermutationScheme(UniversalPermutations)}} {
+		all := NewMinhash(1, 128, opts...)
+		hashing(all, 0, 1000, d)
+		m := NewMinhash(1, 128, opts...)
+		hashing(m, 0, 500, d)
+		sig := append([]uint64(nil), m.Signature()...)
+		restored := NewMinhashFromSignature(1, sig, opts...)
+		hashing(restored, 500, 1000, d)
+		if !sameSignature(restored.Signature(), all.Signature()) {
+			t.Error("Signature of restored Minhash is different after pushing the remaining values")
+		}
+		// The restored Minhash keeps a copy of the signature.
+		if !sameSignature(sig, m.Signature()) {
+			t.Error("Signature given to NewMinhashFromSignature was modified")
+		}
+	}
+}
+
+func TestMinhashSignatureUnchanged(t *testing.T) {
+	// The signatures are the same as those of github.com/dgryski/go-minhash,
+	// so existing signatures stay compatible.
+	m := NewMinhash(1, 4)
+	for _, v := range []string{"a", "b", "c"} {
+		m.Push([]byte(v))
+	}
+	expected := []uint64{0x46e379980e457f70, 0x6c4f23b61068346d, 0x91bacad4128ae451, 0xb72671f214ad9435}
+	if !sameSignature(m.Signature(), expected) {
+		t.Errorf("Expected signature %#v, got %#v", expected, m.Signature())
+	}
+}
+
+func TestMinhashMarshalBinary(t *testing.T) {
+	d := data(1000)
+	for _, newMinhash := range []func(int64, int, ...MinhashOption) *Minhash{NewMinhash, NewOnePermutationMinhash} {
+		all := newMinhash(7, 128)
+		hashing(all, 0, 1000, d)
+		m := newMinhash(7, 128)
+		hashing(m, 0, 10, d)
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var restored Minhash
+		if err := restored.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !sameSignature(restored.Signature(), m.Signature()) {
+			t.Error("Signature of unmarshaled Minhash is different")
+		}
+		hashing(&restored, 10, 1000, d)
+		if !sameSignature(restored.Signature(), all.Signature()) {
+			t.Error("Signature of unmarshaled Minhash is different after pushing the remaining values")
+		}
+		if err := restored.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Error("Expected error unmarshaling truncated data")
+		}
+	}
+}
+
+func TestMinhashUnmarshalBinaryVersion1(t *testing.T) {
+	d := data(100)
+	m := NewMinhash(7, 128)
+	hashing(m, 0, 100, d)
+	data, _ := m.MarshalBinary()
+	// Version 1 has no hash family after the sketch kind.
+	data = append([]byte{1, data[1]}, data[3:]...)
+	var restored Minhash
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !sameSignature(restored.Signature(), m.Signature()) {
+		t.Error("Signature of Minhash unmarshaled from version 1 is different")
+	}
+	o := NewOnePermutationMinhash(7, 128)
+	hashing(o, 0, 100, d)
+	data, _ = o.MarshalBinary()
+	data = append([]byte{1, data[1]}, data[3:]...)
+	if err := restored.UnmarshalBinary(data); err == nil {
+		t.Error("Expected error unmarshaling one-permutation Minhash of version 1")
+	}
+}
+
+func TestMinhashPushParallel(t *testing.T) {
+	d := data(10000)
+	for _, newMinhash := range []func(int64, int, ...MinhashOption) *Minhash{NewMinhash, NewOnePermutationMinhash} {
+		sequential := newMinhash(1, 128)
+		hashing(sequential, 0, len(d), d)
+		batch := newMinhash(1, 128)
+		batch.PushBatch(d)
+		if !sameSignature(batch.Signature(), sequential.Signature()) {
+			t.Error("Signature of PushBatch is different from sequential pushes")
+		}
+		for _, numWorkers := range []int{0, 1, 3, 8} {
+			parallel := newMinhash(1, 128)
+			if err := parallel.PushParallel(d, numWorkers); err != nil {
+				t.Fatal(err)
+			}
+			if !sameSignature(parallel.Signature(), sequential.Signature()) {
+				t.Errorf("Signature of PushParallel with %d workers is different from sequential pushes",
+					numWorkers)
+			}
+		}
+	}
+	// Weighted MinHash objects reject values pushed to more than one
+	// shard, instead of dropping the shards.
+	weighted := NewWeightedMinhash(1, 128)
+	if err := weighted.PushParallel(d, 4); err != nil {
+		t.Fatal(err)
+	}
+	sequential := NewWeightedMinhash(1, 128)
+	sequential.PushBatch(d)
+	if !sameSignature(weighted.Signature(), sequential.Signature()) {
+		t.Error("Signature of weighted PushParallel is different from sequential pushes")
+	}
+	repeated := append(append([][]byte(nil), d[:100]...), d[:100]...)
+	weighted = NewWeightedMinhash(1, 128)
+	if err := weighted.PushParallel(repeated, 2); err != errWeightedOverlap {
+		t.Fatal("Expected weighted overlap error, got", err)
+	}
+	if !sameSignature(weighted.Signature(), NewWeightedMinhash(1, 128).Signature()) {
+		t.Error("Failed weighted PushParallel changed the signature")
+	}
+}
+
+func benchmarkPush(b *testing.B, m *Minhash) {
+	d := data(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Push(d[i%len(d)])
+	}
+}
+
+func BenchmarkPushMinWise256(b *testing.B) {
+	benchmarkPush(b, NewMinhash(1, 256))
+}
+
+func BenchmarkPushOnePermutation256(b *testing.B) {
+	benchmarkPush(b, NewOnePermutationMinhash(1, 256))
+}
+
+func BenchmarkPushParallelMinWise256(b *testing.B) {
+	d := data(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewMinhash(1, 256).PushParallel(d, 0)
+	}
+}
+
+func BenchmarkPushBatchMinWise256(b *testing.B) {
+	d := data(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewMinhash(1, 256).PushBatch(d)
+	}
+}
+
 func BenchmarkMinWise64(b *testing.B) {
 	benchmark(64, b.N, b)
 }
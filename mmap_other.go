@@ -0,0 +1,15 @@
+//go:build !unix
+
+package lshensemble
+
+import "os"
+
+// mmapFile reads the content of the file at path into memory on
+// platforms without mmap support.
+func mmapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
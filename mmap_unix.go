@@ -0,0 +1,34 @@
+//go:build unix
+
+package lshensemble
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the content of the file at path into memory as
+// read-only, shared pages.
+func mmapFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, nil
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(info.Size()),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,102 @@
+package lshensemble
+
+import (
+	"fmt"
+)
+
+// Objective is the objective of choosing the LSH parameters K and L,
+// given their false positive and negative probabilities.
+// The zero value minimizes the sum of the probabilities with equal
+// weights, which is the default.
+type Objective struct {
+	// FalsePositiveWeight and FalseNegativeWeight are the non-negative
+	// weights of the probabilities in the minimized weighted sum.
+	// If both are zero, the weights are 1.
+	FalsePositiveWeight float64
+	FalseNegativeWeight float64
+	// MaxFalseNegative, if positive, makes the parameters minimize the
+	// false positive probability, subject to the false negative
+	// probability being no greater than MaxFalseNegative, and the
+	// weights are ignored. If no parameters meet the target, the ones
+	// with the least false negative probability are chosen.
+	MaxFalseNegative float64
+}
+
+// WeightedObjective returns the objective of minimizing the weighted sum
+// of the false positive and negative probabilities, e.g., a larger fnWeight
+// favors recall over precision.
+func WeightedObjective(fpWeight, fnWeight float64) Objective {
+	return Objective{FalsePositiveWeight: fpWeight, FalseNegativeWeight: fnWeight}
+}
+
+// MaxFalseNegativeObjective returns the objective of minimizing the false
+// positive probability, subject to the false negative probability being
+// no greater than maxFn.
+func MaxFalseNegativeObjective(maxFn float64) Objective {
+	return Objective{MaxFalseNegative: maxFn}
+}
+
+// WithObjective makes the index choose the LSH parameters of queries using
+// the objective, unless another objective is given to the query.
+// The objective is saved by WriteTo.
+func WithObjective(obj Objective) Option {
+	return func(c *config) {
+		c.objective = obj
+	}
+}
+
+func (o Objective) weights() (fpWeight, fnWeight float64) {
+	if o.FalsePositiveWeight == 0 && o.FalseNegativeWeight == 0 {
+		return 1.0, 1.0
+	}
+	return o.FalsePositiveWeight, o.FalseNegativeWeight
+}
+
+// String returns the objective as part of parameter cache keys.
+func (o Objective) String() string {
+	return fmt.Sprintf("%g %g %g", o.FalsePositiveWeight, o.FalseNegativeWeight, o.MaxFalseNegative)
+}
+
+// klSearch keeps the best K and L found under an objective.
+type klSearch struct {
+	obj    Objective
+	found  bool
+	k, l   int
+	fp, fn float64
+}
+
+// add considers the parameters k and l with their false positive
+// and negative probabilities, and keeps them if they are better
+// than the best so far.
+func (s *klSearch) add(k, l int, fp, fn float64) {
+	if !s.found || s.better(fp, fn) {
+		s.found = true
+		s.k, s.l, s.fp, s.fn = k, l, fp, fn
+	}
+}
+
+func (s *klSearch) better(fp, fn float64) bool {
+	if max := s.obj.MaxFalseNegative; max > 0 {
+		feasible, bestFeasible := fn <= max, s.fn <= max
+		switch {
+		case feasible && bestFeasible:
+			return fp < s.fp || (fp == s.fp && fn < s.fn)
+		case feasible != bestFeasible:
+			return feasible
+		default:
+			return fn < s.fn
+		}
+	}
+	fpWeight, fnWeight := s.obj.weights()
+	return fpWeight*fp+fnWeight*fn < fpWeight*s.fp+fnWeight*s.fn
+}
+
+func (s *klSearch) result() (optK, optL int, fp, fn float64) {
+	return s.k, s.l, s.fp, s.fn
+}
+
+// objectiveLsh is implemented by the Lsh types of this package, which
+// can choose the LSH parameters under an objective.
+type objectiveLsh interface {
+	optimalKL(m measure, x, q int, t float64, obj Objective, tolerance float64) (optK, optL int, fp, fn float64)
+}
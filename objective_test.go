@@ -0,0 +1,100 @@
+package lshensemble
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_OptimalKLObjective(t *testing.T) {
+	x, q, threshold := 200, 100, 0.5
+	lshes := map[string]Lsh{
+		"LshForest":      NewLshForest(4, 32, 1),
+		"LshForestArray": NewLshForestArray(4, 128, 1),
+	}
+	for name, lsh := range lshes {
+		_, _, fp, fn := lsh.OptimalKL(x, q, threshold)
+		// Favoring recall must not increase the false negatives.
+		recall := lsh.(objectiveLsh)
+		_, _, fpRecall, fnRecall := recall.optimalKL(containmentMeasure, x, q, threshold, WeightedObjective(1, 10), defaultIntegrationTolerance)
+		if fnRecall > fn || fpRecall < fp {
+			t.Errorf("%s: weighted objective gave fp = %f, fn = %f, default fp = %f, fn = %f",
+				name, fpRecall, fnRecall, fp, fn)
+		}
+		// The target must be met with the least false positives.
+		maxFn := fn / 2
+		k, l, fpTarget, fnTarget := recall.optimalKL(containmentMeasure, x, q, threshold, MaxFalseNegativeObjective(maxFn), defaultIntegrationTolerance)
+		if fnTarget > maxFn {
+			t.Fatalf("%s: false negative %f exceeds the target %f", name, fnTarget, maxFn)
+		}
+		for l2 := 1; l2 <= 32; l2++ {
+			for k2 := 1; k2 <= 4; k2++ {
+				if name == "LshForestArray" && k2*l2 > 128 {
+					continue
+				}
+				fp2, fn2 := containmentProbs(x, q, defaultHashValueBits(), threshold, defaultIntegrationTolerance)(l2, k2)
+				if fn2 <= maxFn && fp2 < fpTarget {
+					t.Fatalf("%s: k = %d, l = %d has less false positives than k = %d, l = %d",
+						name, k2, l2, k, l)
+				}
+			}
+		}
+		// An unreachable target chooses the least false negatives.
+		_, _, _, fnMin := recall.optimalKL(containmentMeasure, x, q, threshold, MaxFalseNegativeObjective(1e-300), defaultIntegrationTolerance)
+		if fnMin > fnTarget {
+			t.Errorf("%s: expected the least false negatives, got %f", name, fnMin)
+		}
+	}
+}
+
+func Test_LshEnsembleObjective(t *testing.T) {
+	recs := testDomainRecords(128)
+	obj := MaxFalseNegativeObjective(0.01)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) }, WithObjective(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := recs[0]
+	// The parameter cache must keep the objectives apart.
+	defaults := index.computeParams(rec.Size, 0.5, containmentMeasure, Objective{})
+	params := index.computeParams(rec.Size, 0.5, containmentMeasure, obj)
+	for i := range params {
+		if params[i].fn > 0.01 && params[i].fn > defaults[i].fn {
+			t.Errorf("Partition %d: false negative %f does not meet the objective", i, params[i].fn)
+		}
+	}
+	for i, p := range index.Explain(rec.Size, 0.5).Partitions {
+		if p.K != params[i].k || p.L != params[i].l {
+			t.Errorf("Partition %d: expected the objective of the index to be used", i)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.objective != obj {
+		t.Fatalf("Expected objective %v, got %v", obj, loaded.objective)
+	}
+	var keys []interface{}
+	for key := range index.QueryWithObjective(rec.Signature, rec.Size, 0.5, Objective{}, nil) {
+		keys = append(keys, key)
+	}
+	expected := make([]interface{}, 0)
+	for i, lsh := range index.lshes {
+		out := make(chan interface{})
+		go func() {
+			lsh.Query(rec.Signature, defaults[i].k, defaults[i].l, out, nil)
+			close(out)
+		}()
+		for key := range out {
+			expected = append(expected, key)
+		}
+	}
+	if !sameKeys(expected, keys) {
+		t.Fatalf("Query results mismatch %v, %v", expected, keys)
+	}
+}
@@ -0,0 +1,114 @@
+package lshensemble
+
+import (
+	"math/rand"
+)
+
+// onePermutation is a one permutation hashing sketch
+// (https://arxiv.org/abs/1208.1259), which hashes every pushed value
+// once, and keeps the minimum hash value in each of the numHash bins
+// selected by the hash value.
+// Empty bins are filled using optimal densification
+// (http://proceedings.mlr.press/v70/shrivastava17a.html).
+type onePermutation struct {
+	hash   func([]byte) uint64
+	seed   uint64
+	bins   []uint64
+	filled []bool
+}
+
+// NewOnePermutationMinhash initializes a MinHash object using one
+// permutation hashing with a seed and the number of hash functions,
+// i.e., the number of bins.
+// Every pushed value is hashed once rather than numHash times, and the
+// signatures are compatible with the ones of NewMinhash in shape, so they
+// can be indexed and used in Containment the same way.
+// Signatures created by NewMinhash and NewOnePermutationMinhash must not
+// be compared with each other.
+// opts are the options to choose the hash family, it panics if given a
+// permutation scheme other than LinearPermutations.
+func NewOnePermutationMinhash(seed int64, numHash int, opts ...MinhashOption) *Minhash {
+	c := newMinhashConfig(opts)
+	if c.scheme != LinearPermutations {
+		panic("one permutation MinHash does not support permutation schemes")
+	}
+	return newMinhash(seed, numHash, sketchOnePermutation, c.family)
+}
+
+func newOnePermutation(r *rand.Rand, family HashFamily, numHash int) *onePermutation {
+	h1, _ := seededHashes(r, family)
+	return &onePermutation{
+		hash:   h1,
+		seed:   uint64(r.Int63()),
+		bins:   make([]uint64, numHash),
+		filled: make([]bool, numHash),
+	}
+}
+
+// bin returns the bin of a hash value, using its high-order 32 bits.
+func (o *onePermutation) bin(hv uint64) int {
+	return int((hv >> 32) * uint64(len(o.bins)) >> 32)
+}
+
+func (o *onePermutation) Push(b []byte) {
+	// The high-order bits of FNV are not uniform enough to select bins.
+	hv := splitmix64(o.hash(b))
+	i := o.bin(hv)
+	if !o.filled[i] || hv < o.bins[i] {
+		o.bins[i] = hv
+		o.filled[i] = true
+	}
+}
+
+// merge updates the bins to the minimum hash values of the bins of
+// both sketches.
+func (o *onePermutation) merge(other *onePermutation) {
+	for i, filled := range other.filled {
+		if filled && (!o.filled[i] || other.bins[i] < o.bins[i]) {
+			o.bins[i] = other.bins[i]
+			o.filled[i] = true
+		}
+	}
+}
+
+// Signature returns the minimum hash values of the bins, where every
+// empty bin takes the value of the first non-empty bin in its sequence of
+// bins chosen by a seeded hash, so the same empty bins of two sets are
+// filled from the same bins.
+// If no value has been pushed, all hash values are the maximum uint64.
+func (o *onePermutation) Signature() []uint64 {
+	sig := make([]uint64, len(o.bins))
+	var numFilled int
+	for i, filled := range o.filled {
+		if filled {
+			sig[i] = o.bins[i]
+			numFilled++
+		}
+	}
+	for i, filled := range o.filled {
+		if filled {
+			continue
+		}
+		if numFilled == 0 {
+			sig[i] = maxHashValue
+			continue
+		}
+		for attempt := uint64(0); ; attempt++ {
+			j := int(splitmix64(o.seed^uint64(i)<<32^attempt) % uint64(len(o.bins)))
+			if o.filled[j] {
+				sig[i] = o.bins[j]
+				break
+			}
+		}
+	}
+	return sig
+}
+
+// splitmix64 is the finalizer of the SplitMix64 generator, which
+// scrambles x into a uniformly distributed hash value.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
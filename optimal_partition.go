@@ -4,136 +4,123 @@ import (
 	"math"
 )
 
-// Computes the expected number of false positives caused by using the
-// upper bound set size of the set size interval given by indexes l and u.
-func computeNFP(l, u int, sizes, counts []int) float64 {
-	if l > u {
-		panic("l must be less or equal to u")
-	}
-	var sum float64
-	for i := l; i <= u; i++ {
-		sum += float64(sizes[u]-sizes[i]) / float64(sizes[u]) * float64(counts[i])
-	}
-	return sum
+// nfpTable computes the expected number of false positives of set size
+// intervals in constant time using prefix sums over the sorted domain
+// of sizes.
+type nfpTable struct {
+	sizes []int
+	// countSums[i] is the total count of sizes[:i], and
+	// sizeSums[i] is the sum of size times count of sizes[:i].
+	countSums []float64
+	sizeSums  []float64
 }
 
-// Computes the matrix of expected number of false positives for all possible
-// sub-intervals of the complete sorted domain of size sizes.
-func computeNFPs(sizes, counts []int) [][]float64 {
-	nfps := make([][]float64, len(sizes))
-	for l := 0; l < len(sizes); l++ {
-		nfps[l] = make([]float64, len(sizes))
-		for u := l; u < len(sizes); u++ {
-			nfps[l][u] = computeNFP(l, u, sizes, counts)
-		}
+func newNFPTable(sizes, counts []int) *nfpTable {
+	t := &nfpTable{
+		sizes:     sizes,
+		countSums: make([]float64, len(sizes)+1),
+		sizeSums:  make([]float64, len(sizes)+1),
+	}
+	for i := range sizes {
+		t.countSums[i+1] = t.countSums[i] + float64(counts[i])
+		t.sizeSums[i+1] = t.sizeSums[i] + float64(sizes[i])*float64(counts[i])
 	}
-	return nfps
+	return t
 }
 
-// The solution of the sub-problem: total NFPs and the upper bound index of
-// the 2nd right-most partition.
-type subSolution struct {
-	totalNFPs float64
-	u1        int
+// Computes the expected number of false positives caused by using the
+// upper bound set size of the set size interval given by indexes l and u,
+// which is the sum of (sizes[u] - sizes[i]) / sizes[u] * counts[i] for i
+// in [l, u].
+func (t *nfpTable) nfp(l, u int) float64 {
+	if l > u {
+		panic("l must be less or equal to u")
+	}
+	count := t.countSums[u+1] - t.countSums[l]
+	sum := t.sizeSums[u+1] - t.sizeSums[l]
+	return math.Max(count-sum/float64(t.sizes[u]), 0.0)
 }
 
 // Computes the optimal partitions given the complete domain of sizes and
-// computed number of expected false positives for all sub-intervals.
-func computeBestPartitions(numPart int, sizes []int, nfps [][]float64) ([]Partition, float64) {
+// the table of expected number of false positives.
+// The partition boundaries are restricted to ends, the sorted indexes of
+// the sizes that can be upper bounds, which must include the last index.
+// Since the expected number of false positives satisfies the quadrangle
+// inequality, the best upper bound of the 2nd right-most partition is
+// monotone in the upper bound of a sub-problem, and each level of the
+// dynamic programming is solved by divide-and-conquer in
+// O(len(ends) log(len(ends))) time.
+func computeBestPartitions(numPart int, sizes []int, ends []int, nfps *nfpTable) ([]Partition, float64) {
 	if numPart < 2 {
 		panic("numPart cannot be less than 2")
 	}
-	if numPart > len(sizes) {
-		panic("numPart cannot be greater than number of sizes")
+	if numPart > len(ends) {
+		panic("numPart cannot be greater than number of upper bounds")
+	}
+	// cost returns the expected number of false positives of the partition
+	// from after the upper bound a to the upper bound b.
+	cost := func(a, b int) float64 {
+		if a < 0 {
+			return nfps.nfp(0, ends[b])
+		}
+		return nfps.nfp(ends[a]+1, ends[b])
+	}
+	// prev holds the minimum total NFPs of the sub-problems with p - 1
+	// partitions, indexed by the upper bound of the sub-problem.
+	prev := make([]float64, len(ends))
+	curr := make([]float64, len(ends))
+	for u := range ends {
+		prev[u] = cost(-1, u)
 	}
-	if numPart == 2 {
-		// If the number of partitions is 2, then simply find the upper bound of
-		// the first partition, so that the partitioning produces the smallest
-		// total expected number of false positives.
+	// splits[p2i(p)][u] is the upper bound of the 2nd right-most partition
+	// of the sub-problem with p partitions and upper bound u.
+	splits := make([][]int32, numPart-1)
+	var p2i = func(p int) int { return p - 2 }
+	// solve computes the sub-problems with p partitions and upper bounds
+	// in [lo, hi], given that their best splits are in [optLo, optHi].
+	var solve func(p, lo, hi, optLo, optHi int)
+	solve = func(p, lo, hi, optLo, optHi int) {
+		if lo > hi {
+			return
+		}
+		mid := (lo + hi) / 2
 		minTotalNFPs := math.MaxFloat64
-		var u int
-		for u1 := 0; u1 < len(sizes)-1; u1++ {
-			totalNFPs := nfps[0][u1] + nfps[u1+1][len(sizes)-1]
+		best := optLo
+		for u1 := optLo; u1 <= optHi && u1 < mid; u1++ {
+			totalNFPs := prev[u1] + cost(u1, mid)
 			if totalNFPs < minTotalNFPs {
 				minTotalNFPs = totalNFPs
-				u = u1
+				best = u1
 			}
 		}
-		return []Partition{
-			Partition{sizes[0], sizes[u]},
-			Partition{sizes[u+1], sizes[len(sizes)-1]},
-		}, minTotalNFPs
-	}
-	// Initialize the matrix for storing the sub-problems' solutions.
-	// The first axis is the upper bound index of the sub-problem, in which
-	// an optimal partitioning of p number of partitions is to be computed.
-	// The second axis is the index of p, see p2i below, starting from 2.
-	sols := make([][]subSolution, numPart-2)
-	for i := range sols {
-		sols[i] = make([]subSolution, len(sizes))
-	}
-	// p is the number of partitions in a sub-problem.
-	// p2i translates the number of partitions into the index in the matrix.
-	var p2i = func(p int) int { return p - 2 }
-	for p := 2; p < numPart; p++ {
-		// The possible upper bound indexes of sub problems start from
-		// p - 1 which is the smallest index to have p partitions.
-		for u := p - 1; u < len(sizes); u++ {
-			minTotalNFPs := math.MaxFloat64
-			var u1Best int
-			if p == 2 {
-				for u1 := 0; u1 < u; u1++ {
-					totalNFPs := nfps[0][u1] + nfps[u1+1][u]
-					if totalNFPs < minTotalNFPs {
-						minTotalNFPs = totalNFPs
-						u1Best = u1
-					}
-				}
-			} else {
-				for u1 := (p - 1) - 1; u1 < u; u1++ {
-					totalNFPs := sols[p2i(p-1)][u1].totalNFPs + nfps[u1+1][u]
-					if totalNFPs < minTotalNFPs {
-						minTotalNFPs = totalNFPs
-						u1Best = u1
-					}
-				}
-			}
-			sols[p2i(p)][u] = subSolution{minTotalNFPs, u1Best}
-		}
+		curr[mid] = minTotalNFPs
+		splits[p2i(p)][mid] = int32(best)
+		solve(p, lo, mid-1, optLo, best)
+		solve(p, mid+1, hi, best, optHi)
 	}
-	// Initialize partitions.
-	partitions := make([]Partition, 0)
-	minTotalNFPs := math.MaxFloat64
-	// Find where to place the right-most partition -- find the upper bound
-	// index of the 2nd right-most partition.
-	var u int
-	p := numPart
-	for u1 := (p - 1) - 1; u1 < len(sizes)-1; u1++ {
-		totalNFPs := sols[p2i(p-1)][u1].totalNFPs + nfps[u1+1][len(sizes)-1]
-		if totalNFPs < minTotalNFPs {
-			u = u1
-			minTotalNFPs = totalNFPs
+	for p := 2; p <= numPart; p++ {
+		splits[p2i(p)] = make([]int32, len(ends))
+		// The possible upper bounds of sub-problems start from p - 1
+		// which is the smallest index to have p partitions, and only the
+		// last upper bound is needed for the complete problem.
+		lo := p - 1
+		if p == numPart {
+			lo = len(ends) - 1
 		}
+		solve(p, lo, len(ends)-1, p-2, len(ends)-2)
+		prev, curr = curr, prev
 	}
-	partitions = append(partitions, Partition{sizes[u+1], sizes[len(sizes)-1]})
-	p--
+	minTotalNFPs := prev[len(ends)-1]
 	// Back-track to find the best partitions using the computed results of
 	// sub-probelms.
-	for p > 1 {
-		// For each sub-problem given p and upper bound index u,
-		// find the upper bound index (u1) of the 2nd right most partition.
-		u1 := sols[p2i(p)][u].u1
-		partitions = append(partitions, Partition{sizes[u1+1], sizes[u]})
-		// Move on to a smaller sub-problem.
+	partitions := make([]Partition, numPart)
+	u := len(ends) - 1
+	for p := numPart; p > 1; p-- {
+		u1 := int(splits[p2i(p)][u])
+		partitions[p-1] = Partition{sizes[ends[u1]+1], sizes[ends[u]]}
 		u = u1
-		p--
-	}
-	// The last partition is the first one.
-	partitions = append(partitions, Partition{sizes[0], sizes[u]})
-	// Reverse the order so the first comes first.
-	for i, j := 0, len(partitions)-1; i < j; i, j = i+1, j-1 {
-		partitions[i], partitions[j] = partitions[j], partitions[i]
 	}
+	partitions[0] = Partition{sizes[0], sizes[ends[u]]}
 	return partitions, minTotalNFPs
 }
 
@@ -141,6 +128,16 @@ func computeBestPartitions(numPart int, sizes []int, nfps [][]float64) ([]Partit
 // as input and returns the optimal partition boundaries (inclusive) for
 // minimizing number of false positives.
 func optimalPartitions(sizes, counts []int, numPart int) []Partition {
+	return approxOptimalPartitions(sizes, counts, numPart, len(sizes))
+}
+
+// approxOptimalPartitions is optimalPartitions with the size distribution
+// coarsened into at most numBins bins of consecutive sizes, and the
+// partition boundaries restricted to the bin boundaries.
+// The number of false positives of each partition is still computed
+// using the complete size distribution.
+// If numBins is less than numPart, numPart bins are used.
+func approxOptimalPartitions(sizes, counts []int, numPart, numBins int) []Partition {
 	if numPart < 2 {
 		return []Partition{Partition{sizes[0], sizes[len(sizes)-1]}}
 	}
@@ -153,7 +150,28 @@ func optimalPartitions(sizes, counts []int, numPart int) []Partition {
 		}
 		return partitions
 	}
-	nfps := computeNFPs(sizes, counts)
-	partitions, _ := computeBestPartitions(numPart, sizes, nfps)
+	if numBins < numPart {
+		numBins = numPart
+	}
+	if numBins > len(sizes) {
+		numBins = len(sizes)
+	}
+	// Every bin holds about the same number of domains, so that the bins
+	// are finest where the domains are concentrated. A bin is also closed
+	// early when each remaining size must get a bin of its own.
+	var total int
+	for _, c := range counts {
+		total += c
+	}
+	ends := make([]int, 0, numBins)
+	var cum int
+	for i := range sizes {
+		cum += counts[i]
+		b := len(ends)
+		if cum*numBins >= (b+1)*total || len(sizes)-i <= numBins-b {
+			ends = append(ends, i)
+		}
+	}
+	partitions, _ := computeBestPartitions(numPart, sizes, ends, newNFPTable(sizes, counts))
 	return partitions
 }
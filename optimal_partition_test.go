@@ -1,6 +1,10 @@
 package lshensemble
 
-import "testing"
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
 
 func Test_OptimalPartitions(t *testing.T) {
 	sizes := make([]int, 100)
@@ -32,3 +36,149 @@ func Test_OptimalPartitions(t *testing.T) {
 		t.Fatal("numPart = 1 produced incorrect partition.")
 	}
 }
+
+// naiveOptimalPartitions is the previous O(p*n^2) partitioner using the
+// O(n^3) matrix of NFPs, used as the reference for optimalPartitions.
+func naiveOptimalPartitions(sizes, counts []int, numPart int) ([]Partition, float64) {
+	n := len(sizes)
+	nfps := make([][]float64, n)
+	for l := 0; l < n; l++ {
+		nfps[l] = make([]float64, n)
+		for u := l; u < n; u++ {
+			for i := l; i <= u; i++ {
+				nfps[l][u] += float64(sizes[u]-sizes[i]) / float64(sizes[u]) * float64(counts[i])
+			}
+		}
+	}
+	// sols[p][u] is the minimum total NFPs of p+1 partitions of sizes[:u+1],
+	// and splits[p][u] is the upper bound of its 2nd right-most partition.
+	sols := make([][]float64, numPart)
+	splits := make([][]int, numPart)
+	for p := range sols {
+		sols[p] = make([]float64, n)
+		splits[p] = make([]int, n)
+		for u := p; u < n; u++ {
+			if p == 0 {
+				sols[p][u] = nfps[0][u]
+				continue
+			}
+			sols[p][u] = math.MaxFloat64
+			for u1 := p - 1; u1 < u; u1++ {
+				if total := sols[p-1][u1] + nfps[u1+1][u]; total < sols[p][u] {
+					sols[p][u] = total
+					splits[p][u] = u1
+				}
+			}
+		}
+	}
+	partitions := make([]Partition, numPart)
+	u := n - 1
+	for p := numPart - 1; p > 0; p-- {
+		u1 := splits[p][u]
+		partitions[p] = Partition{sizes[u1+1], sizes[u]}
+		u = u1
+	}
+	partitions[0] = Partition{sizes[0], sizes[u]}
+	return partitions, sols[numPart-1][n-1]
+}
+
+// totalNFPs returns the expected number of false positives of partitions.
+func totalNFPs(sizes, counts []int, partitions []Partition) float64 {
+	var total float64
+	var l int
+	for _, p := range partitions {
+		for i := l; i < len(sizes) && sizes[i] <= p.Upper; i++ {
+			total += float64(p.Upper-sizes[i]) / float64(p.Upper) * float64(counts[i])
+			l = i + 1
+		}
+	}
+	return total
+}
+
+func randomSizeDistribution(n int, seed int64) (sizes, counts []int) {
+	r := rand.New(rand.NewSource(seed))
+	sizes = make([]int, n)
+	counts = make([]int, n)
+	var size int
+	for i := range sizes {
+		size += 1 + r.Intn(20)
+		sizes[i] = size
+		// Smaller domains are more common.
+		counts[i] = 1 + r.Intn(1000)/(i+1)
+	}
+	return sizes, counts
+}
+
+func Test_OptimalPartitionsMatchNaive(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		sizes, counts := randomSizeDistribution(60, seed)
+		for _, numPart := range []int{2, 3, 8, 16} {
+			partitions := optimalPartitions(sizes, counts, numPart)
+			if len(partitions) != numPart {
+				t.Fatalf("Expected %d partitions, got %d", numPart, len(partitions))
+			}
+			if partitions[0].Lower != sizes[0] || partitions[numPart-1].Upper != sizes[len(sizes)-1] {
+				t.Fatalf("Partitions %v do not cover all sizes", partitions)
+			}
+			_, expected := naiveOptimalPartitions(sizes, counts, numPart)
+			if total := totalNFPs(sizes, counts, partitions); math.Abs(total-expected) > 1e-6*expected {
+				t.Errorf("Seed %d, %d partitions: expected total NFPs %f, got %f",
+					seed, numPart, expected, total)
+			}
+		}
+	}
+}
+
+func Test_ApproxOptimalPartitions(t *testing.T) {
+	sizes, counts := randomSizeDistribution(1000, 1)
+	numPart := 8
+	exact := totalNFPs(sizes, counts, optimalPartitions(sizes, counts, numPart))
+	partitions := approxOptimalPartitions(sizes, counts, numPart, 100)
+	if len(partitions) != numPart {
+		t.Fatalf("Expected %d partitions, got %d", numPart, len(partitions))
+	}
+	approx := totalNFPs(sizes, counts, partitions)
+	if approx < exact-1e-6*exact {
+		t.Errorf("Approximate total NFPs %f is less than optimal %f", approx, exact)
+	}
+	// With 100 bins the approximation must stay within 10% of optimal.
+	if approx > 1.1*exact {
+		t.Errorf("Approximate total NFPs %f is more than 10%% above optimal %f", approx, exact)
+	}
+	// Too few bins must still produce numPart partitions.
+	if partitions := approxOptimalPartitions(sizes, counts, numPart, 2); len(partitions) != numPart {
+		t.Errorf("Expected %d partitions, got %d", numPart, len(partitions))
+	}
+}
+
+func benchmarkOptimalPartitions(b *testing.B, n int, partitioner func(sizes, counts []int, numPart int)) {
+	sizes, counts := randomSizeDistribution(n, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		partitioner(sizes, counts, 16)
+	}
+}
+
+func Benchmark_NaiveOptimalPartitions500(b *testing.B) {
+	benchmarkOptimalPartitions(b, 500, func(sizes, counts []int, numPart int) {
+		naiveOptimalPartitions(sizes, counts, numPart)
+	})
+}
+
+func Benchmark_OptimalPartitions500(b *testing.B) {
+	benchmarkOptimalPartitions(b, 500, func(sizes, counts []int, numPart int) {
+		optimalPartitions(sizes, counts, numPart)
+	})
+}
+
+func Benchmark_OptimalPartitions500000(b *testing.B) {
+	benchmarkOptimalPartitions(b, 500000, func(sizes, counts []int, numPart int) {
+		optimalPartitions(sizes, counts, numPart)
+	})
+}
+
+func Benchmark_ApproxOptimalPartitions500000(b *testing.B) {
+	benchmarkOptimalPartitions(b, 500000, func(sizes, counts []int, numPart int) {
+		approxOptimalPartitions(sizes, counts, numPart, 10000)
+	})
+}
@@ -0,0 +1,148 @@
+package lshensemble
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+var (
+	errEmptyParamGrid = errors.New("Query sizes and thresholds of the parameter table must not be empty")
+)
+
+// klValidator is implemented by the Lsh types of this package, which
+// support queries of bounded parameters K and L.
+type klValidator interface {
+	validKL(k, l int) bool
+}
+
+// tableParam is the serialized form of param.
+type tableParam struct {
+	K, L   int
+	FP, FN float64
+}
+
+// paramTable holds the LSH parameters of every partition precomputed for
+// a grid of query sizes and containment thresholds, using an objective.
+type paramTable struct {
+	// Uppers are the upper bounds of the partitions when the table was
+	// computed, the parameters of a partition whose upper bound has
+	// changed are not used.
+	Uppers     []int
+	QuerySizes []int
+	Thresholds []float64
+	Objective  Objective
+	// Params holds the parameters of the query size i, the threshold j
+	// and the partition p at (i*len(Thresholds)+j)*len(Uppers)+p.
+	Params []tableParam
+}
+
+// PrecomputeParams computes the LSH parameters of every partition for
+// all combinations of the query sizes and the containment thresholds,
+// using the objective of the index, so queries do not compute them.
+// A query uses the parameters of the grid query size nearest to its size
+// in ratio, and of the largest grid threshold not greater than its
+// threshold. Queries of sizes or thresholds out of the grid, other
+// objectives, or Jaccard similarity compute their parameters as usual.
+// The table is saved by WriteTo, and replaces the previous table.
+// It must be called after the partitions are final, e.g., after
+// bootstrapping, and not concurrently with queries.
+func (e *LshEnsembleOf[K]) PrecomputeParams(querySizes []int, thresholds []float64) error {
+	if len(querySizes) == 0 || len(thresholds) == 0 {
+		return errEmptyParamGrid
+	}
+	for _, size := range querySizes {
+		if size <= 0 {
+			return errQuerySize
+		}
+	}
+	for _, t := range thresholds {
+		if t < 0.0 || t > 1.0 {
+			return errQueryThreshold
+		}
+	}
+	table := &paramTable{
+		Uppers:     make([]int, len(e.Partitions)),
+		QuerySizes: append([]int(nil), querySizes...),
+		Thresholds: append([]float64(nil), thresholds...),
+		Objective:  e.objective,
+	}
+	sort.Ints(table.QuerySizes)
+	sort.Float64s(table.Thresholds)
+	table.Params = make([]tableParam, len(table.QuerySizes)*len(table.Thresholds)*len(e.Partitions))
+	var wg sync.WaitGroup
+	wg.Add(len(e.Partitions))
+	for p := range e.Partitions {
+		table.Uppers[p] = e.Partitions[p].Upper
+		go func(p int) {
+			defer wg.Done()
+			lsh := e.lshes[p].(objectiveLsh)
+			for i, size := range table.QuerySizes {
+				for j, t := range table.Thresholds {
+					k, l, fp, fn := lsh.optimalKL(containmentMeasure, table.Uppers[p], size, t, table.Objective, e.tolerance)
+					table.Params[table.index(i, j, p)] = tableParam{k, l, fp, fn}
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	e.paramTable = table
+	return nil
+}
+
+// valid reports whether the table read from an index file is complete
+// and sorted.
+func (t *paramTable) valid() bool {
+	return len(t.QuerySizes) > 0 && len(t.Thresholds) > 0 &&
+		sort.IntsAreSorted(t.QuerySizes) && sort.Float64sAreSorted(t.Thresholds) &&
+		len(t.Params) == len(t.QuerySizes)*len(t.Thresholds)*len(t.Uppers)
+}
+
+// validFor reports whether the table has the parameters of every
+// partition of the index e, which are supported by their Lsh.
+func validFor[K comparable](t *paramTable, e *LshEnsembleOf[K]) bool {
+	if len(t.Uppers) != len(e.Partitions) {
+		return false
+	}
+	for i, param := range t.Params {
+		lsh, ok := e.lshes[i%len(t.Uppers)].(klValidator)
+		if ok && !lsh.validKL(param.K, param.L) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *paramTable) index(i, j, p int) int {
+	return (i*len(t.Thresholds)+j)*len(t.Uppers) + p
+}
+
+// lookup returns the precomputed parameters of the partition p with the
+// upper bound x, and false if the table does not cover the query.
+func (t *paramTable) lookup(p, x, size int, threshold float64, m measure, obj Objective) (param, bool) {
+	if t == nil || m != containmentMeasure || obj != t.Objective ||
+		p >= len(t.Uppers) || t.Uppers[p] != x {
+		return param{}, false
+	}
+	sizes := t.QuerySizes
+	if size < sizes[0] || size > sizes[len(sizes)-1] {
+		return param{}, false
+	}
+	// The nearest grid size in ratio.
+	i := sort.SearchInts(sizes, size)
+	if sizes[i] != size && math.Log(float64(size)/float64(sizes[i-1])) < math.Log(float64(sizes[i])/float64(size)) {
+		i--
+	}
+	// The largest grid threshold not greater than the threshold, which
+	// chooses parameters of no less recall.
+	j := sort.SearchFloat64s(t.Thresholds, threshold)
+	if j == len(t.Thresholds) || t.Thresholds[j] != threshold {
+		j--
+	}
+	if j < 0 {
+		return param{}, false
+	}
+	tp := t.Params[t.index(i, j, p)]
+	return param{tp.K, tp.L, tp.FP, tp.FN}, true
+}
@@ -0,0 +1,120 @@
+package lshensemble
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_LshEnsemblePrecomputeParams(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.PrecomputeParams(nil, []float64{0.5}); err != errEmptyParamGrid {
+		t.Fatal("Expected empty grid error, got", err)
+	}
+	if err := index.PrecomputeParams([]int{0}, []float64{0.5}); err != errQuerySize {
+		t.Fatal("Expected query size error, got", err)
+	}
+	if err := index.PrecomputeParams([]int{4}, []float64{1.5}); err != errQueryThreshold {
+		t.Fatal("Expected threshold error, got", err)
+	}
+	sizes := []int{8, 2, 4}
+	thresholds := []float64{0.5, 0.8}
+	if err := index.PrecomputeParams(sizes, thresholds); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for name, e := range map[string]*LshEnsemble{"built": index, "loaded": &loaded} {
+		// Grid points use the exact parameters.
+		for _, size := range sizes {
+			for _, threshold := range thresholds {
+				params := e.computeParams(size, threshold, containmentMeasure, Objective{})
+				for i, p := range e.Partitions {
+					k, l, _, _ := e.lshes[i].OptimalKL(p.Upper, size, threshold)
+					if params[i].k != k || params[i].l != l {
+						t.Fatalf("%s: size %d, threshold %.2f: expected k = %d, l = %d, got %v",
+							name, size, threshold, k, l, params[i])
+					}
+				}
+			}
+		}
+		// Queries within the grid use the nearest size and the lower threshold.
+		params := e.computeParams(5, 0.7, containmentMeasure, Objective{})
+		expected := e.computeParams(4, 0.5, containmentMeasure, Objective{})
+		for i := range params {
+			if params[i] != expected[i] {
+				t.Fatalf("%s: expected bucketed parameters %v, got %v", name, expected[i], params[i])
+			}
+		}
+		if n := e.paramCache.Count(); n != 0 {
+			t.Fatalf("%s: expected no computed parameters, got %d", name, n)
+		}
+		// Queries out of the grid compute their parameters.
+		e.computeParams(16, 0.5, containmentMeasure, Objective{})
+		e.computeParams(4, 0.3, containmentMeasure, Objective{})
+		e.computeParams(4, 0.5, containmentMeasure, WeightedObjective(1, 2))
+		e.computeParams(4, 0.5, jaccardMeasure, Objective{})
+		if n := e.paramCache.Count(); n != 4*len(e.Partitions) {
+			t.Fatalf("%s: expected %d computed parameters, got %d", name, 4*len(e.Partitions), n)
+		}
+	}
+}
+
+func Test_LshEnsembleReadCorruptedParams(t *testing.T) {
+	recs := testDomainRecords(128)
+	domains := func() <-chan *DomainRecord { return Recs2Chan(recs) }
+	forest, err := BootstrapLshEnsembleOptimal(2, 128, 4, domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plus, err := BootstrapLshEnsemblePlusOptimal(2, 128, 4, domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(index *LshEnsemble, corrupt func(table *paramTable)) error {
+		if err := index.PrecomputeParams([]int{4}, []float64{0.5}); err != nil {
+			t.Fatal(err)
+		}
+		corrupt(index.paramTable)
+		var buf bytes.Buffer
+		if _, err := index.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var loaded LshEnsemble
+		_, err := loaded.ReadFrom(&buf)
+		return err
+	}
+	// Tables of other partitions and parameters not supported by the
+	// forests are rejected, instead of failing the queries.
+	for name, corrupt := range map[string]func(table *paramTable){
+		"partitions": func(table *paramTable) {
+			table.Uppers, table.Params = table.Uppers[:1], table.Params[:1]
+		},
+		"zero k":   func(table *paramTable) { table.Params[0].K = 0 },
+		"large k":  func(table *paramTable) { table.Params[0].K = 5 },
+		"zero l":   func(table *paramTable) { table.Params[1].L = 0 },
+		"large l":  func(table *paramTable) { table.Params[1].L = 33 },
+		"plus k*l": func(table *paramTable) { table.Params[0].K, table.Params[0].L = 4, 64 },
+	} {
+		index := forest
+		if name == "plus k*l" {
+			index = plus
+		}
+		if err := read(index, corrupt); err == nil {
+			t.Errorf("%s: expecting corrupted parameter table error", name)
+		}
+	}
+	if err := read(plus, func(table *paramTable) { table.Params[0].K, table.Params[0].L = 2, 64 }); err != nil {
+		t.Fatal(err)
+	}
+}
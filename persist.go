@@ -0,0 +1,614 @@
+package lshensemble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The binary index format starts with a magic number followed by the
+// format version. Files with a different magic number or version are
+// rejected by ReadFrom.
+const (
+	indexMagic         = "LSHE"
+	forestMagic        = "LSHF"
+	indexFormatVersion = 5
+)
+
+// Identifiers of the Lsh implementations stored in an index file.
+const (
+	lshKindForest      = 1
+	lshKindForestArray = 2
+)
+
+// Identifiers of the optional sections following the Lsh implementations
+// in an index file. Each section is written as its identifier, the length
+// of its content, and the content. Sections unknown to the reader are
+// skipped, and the last section is sectionEnd with no length and content.
+const (
+	sectionEnd            = 0
+	sectionSignatureStore = 1
+	sectionObjective      = 2
+	sectionParamTable     = 3
+	sectionTolerance      = 4
+	// sectionConcurrentInserts holds the merge threshold of an index
+	// created using WithConcurrentInserts.
+	sectionConcurrentInserts = 5
+	// sectionMinhashOptions holds the hash family and permutation scheme
+	// recorded by WithMinhashOptions.
+	sectionMinhashOptions = 6
+)
+
+// Lengths read from an index file are not trusted, so at most maxPrealloc
+// elements are allocated for them upfront, and longer contents grow as
+// they are read. A corrupted length then fails with a short read.
+const maxPrealloc = 1 << 16
+
+var (
+	errIndexMagic   = errors.New("Not an LSH Ensemble index file: bad magic number")
+	errForestMagic  = errors.New("Not an LSH Forest file: bad magic number")
+	errLshKind      = errors.New("Unsupported Lsh implementation in index file")
+	errLength       = errors.New("Corrupted length in index file")
+	errForestHeader = errors.New("Corrupted LSH Forest parameters in index file")
+	errForestEntry  = errors.New("Corrupted hash table entry in index file")
+)
+
+// WriteTo serializes the index into w using a versioned binary format,
+// and returns the number of bytes written.
+// Keys are encoded using encoding/gob, so keys that are not of a
+// built-in type must be registered using gob.Register.
+// Domains added but not yet indexed are written as well, and
+// remain unsearchable until Index() is called on the loaded index.
+func (e *LshEnsembleOf[K]) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	if _, err := io.WriteString(cw, indexMagic); err != nil {
+		return cw.n, err
+	}
+	header := []uint64{
+		indexFormatVersion,
+		uint64(e.numHash),
+		uint64(e.maxK),
+		uint64(len(e.Partitions)),
+	}
+	if err := writeUints(cw, header...); err != nil {
+		return cw.n, err
+	}
+	for _, p := range e.Partitions {
+		if err := writeUints(cw, uint64(p.Lower), uint64(p.Upper)); err != nil {
+			return cw.n, err
+		}
+	}
+	for _, lsh := range e.lshes {
+		if err := writeLsh(cw, lsh); err != nil {
+			return cw.n, err
+		}
+	}
+	if e.store != nil {
+		if err := writeSection(cw, sectionSignatureStore, e.store.data()); err != nil {
+			return cw.n, err
+		}
+	}
+	if e.objective != (Objective{}) {
+		if err := writeSection(cw, sectionObjective, e.objective); err != nil {
+			return cw.n, err
+		}
+	}
+	if e.tolerance != defaultIntegrationTolerance {
+		if err := writeSection(cw, sectionTolerance, e.tolerance); err != nil {
+			return cw.n, err
+		}
+	}
+	if e.paramTable != nil {
+		if err := writeSection(cw, sectionParamTable, e.paramTable); err != nil {
+			return cw.n, err
+		}
+	}
+	if e.minhash != (minhashConfig{}) {
+		options := []uint64{uint64(e.minhash.family), uint64(e.minhash.scheme)}
+		if err := writeSection(cw, sectionMinhashOptions, options); err != nil {
+			return cw.n, err
+		}
+	}
+	if e.mergeThreshold > 0 {
+		if err := writeSection(cw, sectionConcurrentInserts, e.mergeThreshold); err != nil {
+			return cw.n, err
+		}
+	}
+	err := writeUints(cw, sectionEnd)
+	return cw.n, err
+}
+
+// ReadFrom loads an index serialized by WriteTo from r, replacing the
+// content of e, and returns the number of bytes read.
+// An error is returned if r does not contain an index of the
+// supported format version.
+func (e *LshEnsembleOf[K]) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	numHash, maxK, partitions, err := readIndexHeader(cr)
+	if err != nil {
+		return cr.n, err
+	}
+	lshes := make([]LshOf[K], len(partitions))
+	for i := range lshes {
+		if lshes[i], err = readLsh[K](cr); err != nil {
+			return cr.n, err
+		}
+	}
+	loaded := newLshEnsemble(partitions, lshes, numHash, maxK, nil)
+	if err := readSections(cr, loaded); err != nil {
+		return cr.n, err
+	}
+	*e = *loaded
+	return cr.n, nil
+}
+
+// WriteTo serializes the LSH Forest into w using a versioned binary
+// format, and returns the number of bytes written.
+// The output can be opened using OpenMmapLshForest.
+func (f *LshForestOf[K]) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	if _, err := io.WriteString(cw, forestMagic); err != nil {
+		return cw.n, err
+	}
+	if err := writeUints(cw, indexFormatVersion); err != nil {
+		return cw.n, err
+	}
+	err := f.write(cw)
+	return cw.n, err
+}
+
+// writeSection writes a section of the gob-encoded content.
+func writeSection(w io.Writer, id uint64, content interface{}) error {
+	if err := writeUints(w, id); err != nil {
+		return err
+	}
+	return writeGob(w, content)
+}
+
+// readSections reads the optional sections into the index e.
+func readSections[K comparable](r io.Reader, e *LshEnsembleOf[K]) error {
+	for {
+		id, err := readUints(r, 1)
+		if err != nil {
+			return err
+		}
+		switch id[0] {
+		case sectionEnd:
+			return nil
+		case sectionSignatureStore:
+			var data signatureStoreData[K]
+			if err := readGob(r, &data); err != nil {
+				return err
+			}
+			e.store = data.store()
+		case sectionParamTable:
+			table := &paramTable{}
+			if err := readGob(r, table); err != nil {
+				return err
+			}
+			if !table.valid() || !validFor(table, e) {
+				return errors.New("Corrupted parameter table in index file")
+			}
+			e.paramTable = table
+		case sectionTolerance:
+			if err := readGob(r, &e.tolerance); err != nil {
+				return err
+			}
+			if !validTolerance(e.tolerance) {
+				return errors.New("Corrupted integration tolerance in index file")
+			}
+		case sectionObjective:
+			if err := readGob(r, &e.objective); err != nil {
+				return err
+			}
+		case sectionMinhashOptions:
+			var options []uint64
+			if err := readGob(r, &options); err != nil {
+				return err
+			}
+			if len(options) != 2 || options[0] > uint64(SipHash) ||
+				options[1] > uint64(UniversalPermutations) {
+				return errors.New("Corrupted Minhash options in index file")
+			}
+			e.minhash = minhashConfig{
+				family: HashFamily(options[0]),
+				scheme: PermutationScheme(options[1]),
+			}
+		case sectionConcurrentInserts:
+			var mergeThreshold int
+			if err := readGob(r, &mergeThreshold); err != nil {
+				return err
+			}
+			if mergeThreshold <= 0 {
+				return errors.New("Corrupted merge threshold in index file")
+			}
+			// Domains added to a delta segment were searchable, so they
+			// are indexed into the main segment.
+			for _, lsh := range e.lshes {
+				if _, ok := lsh.(cloneableLsh[K]); ok {
+					lsh.Index()
+				}
+			}
+			e.mergeThreshold = mergeThreshold
+			e.wrapConcurrentInserts()
+		default:
+			size, err := readUints(r, 1)
+			if err != nil {
+				return err
+			}
+			if err := skipBytes(r, size[0]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readIndexHeader reads the header and the partitions written by
+// LshEnsemble.WriteTo.
+func readIndexHeader(r io.Reader) (numHash, maxK int, partitions []Partition, err error) {
+	if err = readMagic(r, indexMagic, errIndexMagic); err != nil {
+		return
+	}
+	header, err := readUints(r, 3)
+	if err != nil {
+		return
+	}
+	numHash, maxK = int(header[0]), int(header[1])
+	partitions = make([]Partition, 0, prealloc(header[2]))
+	for i := uint64(0); i < header[2]; i++ {
+		bounds, err := readUints(r, 2)
+		if err != nil {
+			return 0, 0, nil, shortRead(err)
+		}
+		partitions = append(partitions, Partition{int(bounds[0]), int(bounds[1])})
+	}
+	return
+}
+
+// readMagic checks the magic number and the format version.
+func readMagic(r io.Reader, magic string, errMagic error) error {
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if string(buf) != magic {
+		return errMagic
+	}
+	version, err := readUints(r, 1)
+	if err != nil {
+		return err
+	}
+	if version[0] != indexFormatVersion {
+		return fmt.Errorf("Unsupported index format version %d, expecting %d",
+			version[0], indexFormatVersion)
+	}
+	return nil
+}
+
+func writeLsh[K comparable](w io.Writer, lsh LshOf[K]) error {
+	switch v := lsh.(type) {
+	case *LshForestOf[K]:
+		if err := writeUints(w, lshKindForest); err != nil {
+			return err
+		}
+		return v.write(w)
+	case *LshForestArrayOf[K]:
+		if err := writeUints(w, lshKindForestArray); err != nil {
+			return err
+		}
+		return v.write(w)
+	case *concurrentLsh[K]:
+		return writeLsh(w, v.flatten())
+	}
+	return errLshKind
+}
+
+func readLsh[K comparable](r io.Reader) (LshOf[K], error) {
+	kind, err := readUints(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	switch kind[0] {
+	case lshKindForest:
+		return readLshForest[K](r)
+	case lshKindForestArray:
+		return readLshForestArray[K](r)
+	}
+	return nil, errLshKind
+}
+
+// write encodes the LSH Forest as its parameters, followed by the
+// keys indexed by their IDs, the released IDs, the IDs of removed keys,
+// and the hash tables, in which each entry is a fixed-width hash key
+// followed by the ID of its key.
+func (f *LshForestOf[K]) write(w io.Writer) error {
+	var numEntries int
+	if len(f.hashTables) > 0 {
+		numEntries = f.hashTables[0].Len()
+	}
+	header := []uint64{
+		uint64(f.k),
+		uint64(f.l),
+		uint64(f.hashValueBits),
+		uint64(f.numIndexedKeys),
+		uint64(numEntries),
+	}
+	if err := writeUints(w, header...); err != nil {
+		return err
+	}
+	if err := writeKeys(w, f.keys); err != nil {
+		return err
+	}
+	if err := writeKeys(w, f.freeIDs); err != nil {
+		return err
+	}
+	tombstones := make([]uint32, 0, len(f.tombstones))
+	for id := range f.tombstones {
+		tombstones = append(tombstones, id)
+	}
+	if err := writeKeys(w, tombstones); err != nil {
+		return err
+	}
+	keySize := hashKeySize(f.k, f.hashValueBits)
+	buf := make([]byte, keySize+4)
+	for i := range f.hashTables {
+		ht := &f.hashTables[i]
+		for j := 0; j < ht.Len(); j++ {
+			copy(buf, ht.hashKey(j))
+			binary.LittleEndian.PutUint32(buf[keySize:], ht.ids[j])
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validIDs reports whether the IDs read from an index file are distinct
+// IDs of the n keys of a forest.
+func validIDs(ids []uint32, n int) bool {
+	seen := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		if int(id) >= n || seen[id] {
+			return false
+		}
+		seen[id] = true
+	}
+	return true
+}
+
+// validForestHeader reports whether the parameters of an LSH Forest
+// read from an index file are valid, which are k, l, the hash value
+// width, the number of indexed entries and the number of entries.
+func validForestHeader(header []uint64) bool {
+	return header[0] <= maxPrealloc && header[1] <= maxPrealloc &&
+		header[2] <= 64 && validHashValueBits(int(header[2])) &&
+		header[3] <= header[4] && header[4] <= math.MaxInt32
+}
+
+func readLshForest[K comparable](r io.Reader) (*LshForestOf[K], error) {
+	header, err := readUints(r, 5)
+	if err != nil {
+		return nil, err
+	}
+	if !validForestHeader(header) {
+		return nil, errForestHeader
+	}
+	k, l, hashValueBits := int(header[0]), int(header[1]), int(header[2])
+	numIndexedKeys, numEntries := int(header[3]), int(header[4])
+	keys, err := readKeys[K](r)
+	if err != nil {
+		return nil, err
+	}
+	freeIDs, err := readKeys[uint32](r)
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := readKeys[uint32](r)
+	if err != nil {
+		return nil, err
+	}
+	if !validIDs(freeIDs, len(keys)) || !validIDs(tombstones, len(keys)) {
+		return nil, errForestEntry
+	}
+	f := newLshForest[K](k, l, hashValueBits, prealloc(header[4]))
+	f.keys = keys
+	f.freeIDs = freeIDs
+	f.tombstones = keySet(tombstones)
+	free := keySet(freeIDs)
+	for id, key := range keys {
+		if !free[uint32(id)] {
+			f.ids[key] = uint32(id)
+		}
+	}
+	keySize := hashKeySize(k, hashValueBits)
+	buf := make([]byte, keySize+4)
+	for i := range f.hashTables {
+		for j := 0; j < numEntries; j++ {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, shortRead(err)
+			}
+			id := binary.LittleEndian.Uint32(buf[keySize:])
+			if int(id) >= len(keys) {
+				return nil, errForestEntry
+			}
+			f.hashTables[i].add(string(buf[:keySize]), id)
+		}
+	}
+	f.numIndexedKeys = numIndexedKeys
+	f.searchable = make([]bool, len(keys))
+	if l > 0 {
+		for _, id := range f.hashTables[0].ids[:numIndexedKeys] {
+			if !f.tombstones[id] {
+				f.setSearchable(id, true)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (a *LshForestArrayOf[K]) write(w io.Writer) error {
+	if err := writeUints(w, uint64(a.maxK), uint64(a.numHash)); err != nil {
+		return err
+	}
+	for _, f := range a.array {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLshForestArray[K comparable](r io.Reader) (*LshForestArrayOf[K], error) {
+	header, err := readUints(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] == 0 || header[0] > maxPrealloc {
+		return nil, errForestHeader
+	}
+	maxK, numHash := int(header[0]), int(header[1])
+	array := make([]*LshForestOf[K], maxK)
+	for i := range array {
+		if array[i], err = readLshForest[K](r); err != nil {
+			return nil, err
+		}
+		// The i-th forest has K of i+1, and the forests index the same
+		// keys, so they share a key table.
+		if array[i].k != i+1 || len(array[i].keys) != len(array[0].keys) {
+			return nil, errForestHeader
+		}
+		array[i].keyTable = array[0].keyTable
+	}
+	return &LshForestArrayOf[K]{
+		maxK:    maxK,
+		numHash: numHash,
+		array:   array,
+	}, nil
+}
+
+// writeGob writes the gob-encoded v prefixed by the encoded length,
+// so the reader does not consume bytes beyond the encoded v.
+func writeGob(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	if err := writeUints(w, uint64(buf.Len())); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func readGob(r io.Reader, v interface{}) error {
+	size, err := readUints(r, 1)
+	if err != nil {
+		return err
+	}
+	if size[0] > math.MaxInt64 {
+		return errLength
+	}
+	var buf bytes.Buffer
+	buf.Grow(prealloc(size[0]))
+	if _, err := io.CopyN(&buf, r, int64(size[0])); err != nil {
+		return shortRead(err)
+	}
+	return gob.NewDecoder(&buf).Decode(v)
+}
+
+// skipBytes discards the next size bytes of r.
+func skipBytes(r io.Reader, size uint64) error {
+	if size > math.MaxInt64 {
+		return errLength
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+		return shortRead(err)
+	}
+	return nil
+}
+
+// prealloc returns the capacity to allocate upfront for n elements
+// whose number is read from an index file.
+func prealloc(n uint64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
+
+// shortRead returns io.ErrUnexpectedEOF if the file ends before the
+// content of a length read from it.
+func shortRead(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeKeys[K comparable](w io.Writer, keys []K) error {
+	return writeGob(w, keys)
+}
+
+func readKeys[K comparable](r io.Reader) ([]K, error) {
+	var keys []K
+	if err := readGob(r, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func keySet[K comparable](keys []K) map[K]bool {
+	set := make(map[K]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+func writeUints(w io.Writer, vs ...uint64) error {
+	buf := make([]byte, 8*len(vs))
+	for i, v := range vs {
+		binary.LittleEndian.PutUint64(buf[i*8:], v)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readUints(r io.Reader, n int) ([]uint64, error) {
+	buf := make([]byte, 8*n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	vs := make([]uint64, n)
+	for i := range vs {
+		vs[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return vs, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,311 @@
+package lshensemble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"testing"
+)
+
+func testDomainRecords(numHash int) []*DomainRecord {
+	domains := [][]string{
+		[]string{"a", "b", "c", "d"},
+		[]string{"e", "f", "g", "h", "i"},
+		[]string{"j", "k", "l", "m", "n", "o"},
+		[]string{"p", "q", "r", "s", "t", "u", "v"},
+	}
+	keys := []string{"1", "2", "3", "4"}
+	domainRecords := make([]*DomainRecord, 0)
+	for i := range domains {
+		mh := NewMinhash(1, numHash)
+		for _, v := range domains[i] {
+			mh.Push([]byte(v))
+		}
+		domainRecords = append(domainRecords, &DomainRecord{
+			Key:       keys[i],
+			Size:      len(domains[i]),
+			Signature: mh.Signature(),
+		})
+	}
+	sort.Sort(BySize(domainRecords))
+	return domainRecords
+}
+
+func queryAll(index *LshEnsemble, recs []*DomainRecord, threshold float64) [][]interface{} {
+	results := make([][]interface{}, len(recs))
+	for i, rec := range recs {
+		results[i], _ = index.QueryTimed(rec.Signature, rec.Size, threshold)
+	}
+	return results
+}
+
+func sameKeys(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[interface{}]int)
+	for _, k := range a {
+		m[k]++
+	}
+	for _, k := range b {
+		m[k]--
+	}
+	for _, c := range m {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_LshEnsembleWriteRead(t *testing.T) {
+	recs := testDomainRecords(128)
+	builders := map[string]func() (*LshEnsemble, error){
+		"LshForest": func() (*LshEnsemble, error) {
+			return BootstrapLshEnsembleOptimal(2, 128, 4,
+				func() <-chan *DomainRecord { return Recs2Chan(recs) })
+		},
+		"LshForestArray": func() (*LshEnsemble, error) {
+			return BootstrapLshEnsemblePlusOptimal(2, 128, 4,
+				func() <-chan *DomainRecord { return Recs2Chan(recs) })
+		},
+	}
+	for name, build := range builders {
+		index, err := build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Removed keys must stay removed after loading.
+		index.Remove(recs[1].Key)
+		var buf bytes.Buffer
+		written, err := index.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != int64(buf.Len()) {
+			t.Fatalf("%s: WriteTo reported %d bytes, wrote %d", name, written, buf.Len())
+		}
+		var loaded LshEnsemble
+		read, err := loaded.ReadFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != written {
+			t.Fatalf("%s: ReadFrom read %d bytes, expecting %d", name, read, written)
+		}
+		if len(loaded.Partitions) != len(index.Partitions) {
+			t.Fatalf("%s: partitions mismatch", name)
+		}
+		for i := range index.Partitions {
+			if loaded.Partitions[i] != index.Partitions[i] {
+				t.Fatalf("%s: partitions mismatch", name)
+			}
+		}
+		expected := queryAll(index, recs, 0.5)
+		actual := queryAll(&loaded, recs, 0.5)
+		for i := range expected {
+			if !sameKeys(expected[i], actual[i]) {
+				t.Fatalf("%s: query results mismatch %v, %v", name, expected[i], actual[i])
+			}
+			for _, key := range actual[i] {
+				if key == recs[1].Key {
+					t.Fatalf("%s: removed key returned", name)
+				}
+			}
+		}
+	}
+}
+
+func Test_LshEnsembleReadFromBadHeader(t *testing.T) {
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(bytes.NewBufferString("NOT AN INDEX FILE")); err != errIndexMagic {
+		t.Fatal("expecting bad magic number error, got", err)
+	}
+
+	index, err := BootstrapLshEnsembleEquiDepth(2, 128, 4, 4,
+		Recs2Chan(testDomainRecords(128)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[len(indexMagic)]++
+	if _, err := loaded.ReadFrom(bytes.NewReader(data)); err == nil {
+		t.Fatal("expecting unsupported version error")
+	}
+}
+
+func Test_LshEnsembleWriteReadSignatureStore(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) },
+		WithSignatureStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.store == nil || len(loaded.store.domains) != len(recs) {
+		t.Fatal("signature store not loaded")
+	}
+	for _, rec := range recs {
+		d, ok := loaded.store.get(rec.Key)
+		if !ok || d.size != rec.Size || Containment(d.sig, rec.Signature, d.size, rec.Size) != 1.0 {
+			t.Fatal("stored domain mismatch", rec.Key)
+		}
+	}
+}
+
+func Test_LshEnsembleOfWriteRead(t *testing.T) {
+	index := NewLshEnsembleOf[uint32]([]Partition{{0, 10}}, 128, 4, 4)
+	recs := testDomainRecords(128)
+	for i, rec := range recs {
+		if err := index.Prepare(uint32(i), rec.Signature, rec.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Index()
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsembleOf[uint32]
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for i, rec := range recs {
+		result, _ := loaded.QueryTimed(rec.Signature, rec.Size, 0.9)
+		var found bool
+		for _, key := range result {
+			if key == uint32(i) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("unable to retrieve inserted key")
+		}
+	}
+}
+
+func Test_LshEnsembleWriteReadHashValueBits(t *testing.T) {
+	recs := testDomainRecords(128)
+	for _, bits := range []int{1, 8} {
+		index, err := BootstrapLshEnsemblePlusOptimal(2, 128, 4,
+			func() <-chan *DomainRecord { return Recs2Chan(recs) }, WithHashValueBits(bits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := index.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var loaded LshEnsemble
+		if _, err := loaded.ReadFrom(&buf); err != nil {
+			t.Fatal(err)
+		}
+		lsh := loaded.lshes[0].(*LshForestArray)
+		if lsh.array[0].hashValueBits != bits {
+			t.Fatalf("Expected %d bits, got %d", bits, lsh.array[0].hashValueBits)
+		}
+		expected := queryAll(index, recs, 0.5)
+		actual := queryAll(&loaded, recs, 0.5)
+		for i := range expected {
+			if !sameKeys(expected[i], actual[i]) {
+				t.Fatalf("%d bits: query results mismatch %v, %v", bits, expected[i], actual[i])
+			}
+			found := false
+			for _, key := range actual[i] {
+				found = found || key == recs[i].Key
+			}
+			if !found {
+				t.Fatalf("%d bits: query did not return itself", bits)
+			}
+		}
+	}
+}
+
+func Test_LshEnsembleReadFromCorruptedLength(t *testing.T) {
+	index, err := BootstrapLshEnsembleEquiDepth(2, 128, 4, 4,
+		Recs2Chan(testDomainRecords(128)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// The number of partitions follows the magic number, the version,
+	// numHash and maxK.
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint64(data[len(indexMagic)+24:], math.MaxUint64)
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Fatal("expecting unexpected EOF error, got", err)
+	}
+
+	for _, size := range []uint64{1 << 62, math.MaxUint64} {
+		var gobBuf bytes.Buffer
+		writeUints(&gobBuf, size)
+		gobBuf.WriteString("short")
+		var keys []string
+		if err := readGob(&gobBuf, &keys); err == nil {
+			t.Fatal("expecting error reading gob of corrupted length", size)
+		}
+	}
+}
+
+func Test_LshForestReadCorruptedIDs(t *testing.T) {
+	for _, corrupt := range []func(f *LshForest){
+		func(f *LshForest) { f.freeIDs = []uint32{100} },
+		func(f *LshForest) { f.freeIDs = []uint32{0, 0} },
+		func(f *LshForest) { f.tombstones = map[uint32]bool{100: true} },
+	} {
+		f := NewLshForest(2, 2, 0)
+		f.Add("a", make([]uint64, 4))
+		f.Index()
+		corrupt(f)
+		var buf bytes.Buffer
+		if err := f.write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readLshForest[interface{}](&buf); err != errForestEntry {
+			t.Errorf("Expected corrupted entry error, got %v", err)
+		}
+	}
+	// An array of forests has at least one forest.
+	var buf bytes.Buffer
+	writeUints(&buf, 0, 4)
+	if _, err := readLshForestArray[interface{}](&buf); err != errForestHeader {
+		t.Errorf("Expected corrupted header error, got %v", err)
+	}
+}
+
+func Test_LshForestWriteReadNoTrees(t *testing.T) {
+	f := NewLshForest(4, 0, 0)
+	f.Add("a", make([]uint64, 4))
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := readMagic(&buf, forestMagic, errForestMagic); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readLshForest[interface{}](&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.l != 0 || len(loaded.keys) != 1 {
+		t.Fatal("forest without trees not loaded")
+	}
+}
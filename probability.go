@@ -2,54 +2,255 @@ package lshensemble
 
 import "math"
 
-// Compute the integral of function f, lower limit a, upper limit l, and
-// precision defined as the quantize step
-func integral(f func(float64) float64, a, b, precision float64) float64 {
-	var area float64
-	for x := a; x < b; x += precision {
-		area += f(x+0.5*precision) * precision
+const (
+	// defaultIntegrationTolerance is the absolute error tolerance of the
+	// integrals of the false positive and negative probabilities, if not
+	// given by WithIntegrationTolerance.
+	defaultIntegrationTolerance = 1e-6
+	// maxIntegrationDepth bounds the number of times an interval is
+	// bisected by the adaptive integration.
+	maxIntegrationDepth = 30
+)
+
+// validTolerance returns true if the integration tolerance is positive
+// and finite.
+func validTolerance(tolerance float64) bool {
+	return tolerance > 0 && !math.IsInf(tolerance, 1)
+}
+
+// Nodes and weights of the 15-point Kronrod rule on [-1, 1], with the
+// 7-point Gauss rule on the odd nodes, from QUADPACK.
+var (
+	kronrodNodes = [8]float64{
+		0.991455371120812639206854697526329,
+		0.949107912342758524526189684047851,
+		0.864864423359769072789712788640926,
+		0.741531185599394439863864773280788,
+		0.586087235467691130294144845693013,
+		0.405845151377397166906606412076961,
+		0.207784955007898467600689403773245,
+		0.0,
+	}
+	kronrodWeights = [8]float64{
+		0.022935322010529224963732008058970,
+		0.063092092629978553290700663189204,
+		0.104790010322250183839876322541518,
+		0.140653259715525918745189590510238,
+		0.169004726639267902826583426598550,
+		0.190350578064785409913256402421014,
+		0.204432940075298892414161999234649,
+		0.209482141084727828012999174891714,
+	}
+	gaussWeights = [4]float64{
+		0.129484966168869693270611432679082,
+		0.279705391489276667901467771423780,
+		0.381830050505118944950369775488975,
+		0.417959183673469387755102040816327,
+	}
+)
+
+// gaussKronrod returns the 15-point Kronrod estimate of the integral of f
+// from a to b, and its difference from the 7-point Gauss estimate as
+// the error estimate.
+func gaussKronrod(f func(float64) float64, a, b float64) (value, errEst float64) {
+	center, half := 0.5*(a+b), 0.5*(b-a)
+	fc := f(center)
+	kronrod := fc * kronrodWeights[7]
+	gauss := fc * gaussWeights[3]
+	for i := 0; i < 7; i++ {
+		dx := half * kronrodNodes[i]
+		sum := f(center-dx) + f(center+dx)
+		kronrod += kronrodWeights[i] * sum
+		if i%2 == 1 {
+			gauss += gaussWeights[i/2] * sum
+		}
 	}
-	return area
+	return kronrod * half, math.Abs((kronrod - gauss) * half)
+}
+
+// integrate computes the integral of function f from a to b using adaptive
+// Gauss-Kronrod quadrature, bisecting the intervals whose error estimates
+// exceed their share of the absolute error tolerance.
+// It returns the integral and the estimated absolute error, which may
+// exceed the tolerance if the bisections reach maxIntegrationDepth.
+func integrate(f func(float64) float64, a, b, tolerance float64) (value, errEst float64) {
+	if b <= a {
+		return 0.0, 0.0
+	}
+	var bisect func(a, b, tolerance float64, depth int) (float64, float64)
+	bisect = func(a, b, tolerance float64, depth int) (float64, float64) {
+		value, errEst := gaussKronrod(f, a, b)
+		if errEst <= tolerance || depth == maxIntegrationDepth {
+			return value, errEst
+		}
+		mid := 0.5 * (a + b)
+		left, leftErr := bisect(a, mid, 0.5*tolerance, depth+1)
+		right, rightErr := bisect(mid, b, 0.5*tolerance, depth+1)
+		return left + right, leftErr + rightErr
+	}
+	return bisect(a, b, tolerance, 0)
+}
+
+// Compute the integral of function f, lower limit a, upper limit b, and
+// the absolute error tolerance
+func integral(f func(float64) float64, a, b, tolerance float64) float64 {
+	value, _ := integrate(f, a, b, tolerance)
+	return value
+}
+
+// containmentJaccard returns the Jaccard similarity of a query domain of
+// size q and an indexed domain of size x, given the containment t of the
+// query domain, which is t / (1 + x/q - t) computed as t*q / (x + q*(1 - t))
+// without the cancellation of 1 + x/q - t when x/q is small.
+func containmentJaccard(x, q int, t float64) float64 {
+	qf := float64(q)
+	return t * qf / (float64(x) + qf*(1.0-t))
+}
+
+// candidateProbability returns 1 - (1 - p^k)^l, the probability of a domain
+// being a candidate given the collision probability p of its hash values,
+// which is accurate when p^k is small.
+func candidateProbability(p float64, k, l int) float64 {
+	return -math.Expm1(missLogProbability(p, k, l))
+}
+
+// missProbability returns (1 - p^k)^l, the probability of a domain not
+// being a candidate given the collision probability p of its hash values.
+func missProbability(p float64, k, l int) float64 {
+	return math.Exp(missLogProbability(p, k, l))
+}
+
+func missLogProbability(p float64, k, l int) float64 {
+	return float64(l) * math.Log1p(-math.Pow(p, float64(k)))
+}
+
+// collisionProbability returns the probability of two hash values trimmed
+// to hashValueBits bits being equal, given the Jaccard similarity s of
+// their domains. Hash values of different minimums collide accidentally
+// with probability 2^-hashValueBits, as in b-bit minwise hashing
+// (https://arxiv.org/abs/0910.3349).
+func collisionProbability(s float64, hashValueBits int) float64 {
+	if hashValueBits >= 64 {
+		return s
+	}
+	return s + (1.0-s)/math.Exp2(float64(hashValueBits))
 }
 
 // Probability density function for false positive
-func falsePositive(x, q, l, k int) func(float64) float64 {
+func falsePositive(x, q, l, k, hashValueBits int) func(float64) float64 {
 	return func(t float64) float64 {
-		return 1.0 - math.Pow(1.0-math.Pow(t/(1.0+float64(x)/float64(q)-t), float64(k)), float64(l))
+		p := collisionProbability(containmentJaccard(x, q, t), hashValueBits)
+		return candidateProbability(p, k, l)
 	}
 }
 
 // Probability density function for false negative
-func falseNegative(x, q, l, k int) func(float64) float64 {
+func falseNegative(x, q, l, k, hashValueBits int) func(float64) float64 {
 	return func(t float64) float64 {
-		return 1.0 - (1.0 - math.Pow(1.0-math.Pow(t/(1.0+float64(x)/float64(q)-t), float64(k)), float64(l)))
+		p := collisionProbability(containmentJaccard(x, q, t), hashValueBits)
+		return missProbability(p, k, l)
 	}
 }
 
 // Compute the cummulative probability of false negative
-func probFalseNegative(x, q, l, k int, t, precision float64) float64 {
-	fn := falseNegative(x, q, l, k)
+func probFalseNegative(x, q, l, k, hashValueBits int, t, tolerance float64) float64 {
+	fn := falseNegative(x, q, l, k, hashValueBits)
 	xq := float64(x) / float64(q)
 	if xq >= 1.0 {
-		return integral(fn, t, 1.0, precision)
+		return integral(fn, t, 1.0, tolerance)
 	}
 	if xq >= t {
-		return integral(fn, t, xq, precision)
+		return integral(fn, t, xq, tolerance)
 	} else {
 		return 0.0
 	}
 }
 
 // Compute the cummulative probability of false positive
-func probFalsePositive(x, q, l, k int, t, precision float64) float64 {
-	fp := falsePositive(x, q, l, k)
+func probFalsePositive(x, q, l, k, hashValueBits int, t, tolerance float64) float64 {
+	fp := falsePositive(x, q, l, k, hashValueBits)
 	xq := float64(x) / float64(q)
 	if xq >= 1.0 {
-		return integral(fp, 0.0, t, precision)
+		return integral(fp, 0.0, t, tolerance)
 	}
 	if xq >= t {
-		return integral(fp, 0.0, t, precision)
+		return integral(fp, 0.0, t, tolerance)
 	} else {
-		return integral(fp, 0.0, xq, precision)
+		return integral(fp, 0.0, xq, tolerance)
+	}
+}
+
+// Probability density function for false positive of Jaccard similarity s
+func jaccardFalsePositive(l, k, hashValueBits int) func(float64) float64 {
+	return func(s float64) float64 {
+		return candidateProbability(collisionProbability(s, hashValueBits), k, l)
+	}
+}
+
+// Probability density function for false negative of Jaccard similarity s
+func jaccardFalseNegative(l, k, hashValueBits int) func(float64) float64 {
+	return func(s float64) float64 {
+		return missProbability(collisionProbability(s, hashValueBits), k, l)
+	}
+}
+
+// maxJaccard returns the maximum Jaccard similarity of a query domain of
+// size q and an indexed domain of size at most x.
+func maxJaccard(x, q int) float64 {
+	if x >= q {
+		return 1.0
+	}
+	return float64(x) / float64(q)
+}
+
+// Compute the cummulative probability of false negative for Jaccard
+// similarity threshold t
+func probJaccardFalseNegative(x, q, l, k, hashValueBits int, t, tolerance float64) float64 {
+	sMax := maxJaccard(x, q)
+	if sMax < t {
+		return 0.0
+	}
+	return integral(jaccardFalseNegative(l, k, hashValueBits), t, sMax, tolerance)
+}
+
+// Compute the cummulative probability of false positive for Jaccard
+// similarity threshold t
+func probJaccardFalsePositive(x, q, l, k, hashValueBits int, t, tolerance float64) float64 {
+	return integral(jaccardFalsePositive(l, k, hashValueBits), 0.0, math.Min(t, maxJaccard(x, q)), tolerance)
+}
+
+// measureProbs returns the probabilities for the similarity measure m.
+func measureProbs(m measure, x, q, hashValueBits int, t, tolerance float64) probFunc {
+	if m == jaccardMeasure {
+		return jaccardProbs(x, q, hashValueBits, t, tolerance)
+	}
+	return containmentProbs(x, q, hashValueBits, t, tolerance)
+}
+
+// probFunc computes the false positive and negative probabilities
+// of the LSH parameters l and k.
+type probFunc func(l, k int) (fp, fn float64)
+
+// containmentProbs returns the probabilities for containment search,
+// where x is the indexed domain size, q is the query domain size,
+// and t is the containment threshold, integrated with the absolute error
+// tolerance.
+func containmentProbs(x, q, hashValueBits int, t, tolerance float64) probFunc {
+	return func(l, k int) (fp, fn float64) {
+		fp = probFalsePositive(x, q, l, k, hashValueBits, t, tolerance)
+		fn = probFalseNegative(x, q, l, k, hashValueBits, t, tolerance)
+		return
+	}
+}
+
+// jaccardProbs returns the probabilities for Jaccard similarity search,
+// where x is the indexed domain size, q is the query domain size,
+// and t is the Jaccard similarity threshold, integrated with the absolute
+// error tolerance.
+func jaccardProbs(x, q, hashValueBits int, t, tolerance float64) probFunc {
+	return func(l, k int) (fp, fn float64) {
+		fp = probJaccardFalsePositive(x, q, l, k, hashValueBits, t, tolerance)
+		fn = probJaccardFalseNegative(x, q, l, k, hashValueBits, t, tolerance)
+		return
 	}
 }
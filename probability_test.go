@@ -0,0 +1,134 @@
+package lshensemble
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func Test_Integrate(t *testing.T) {
+	cases := []struct {
+		name     string
+		f        func(float64) float64
+		a, b     float64
+		expected float64
+	}{
+		{"polynomial", func(x float64) float64 { return math.Pow(x, 10) }, 0, 1, 1.0 / 11},
+		{"sine", math.Sin, 0, math.Pi, 2},
+		// The derivative is unbounded at 0.
+		{"square root", math.Sqrt, 0, 1, 2.0 / 3},
+		{"steep", func(x float64) float64 { return math.Exp(-100 * x) }, 0, 1, (1 - math.Exp(-100)) / 100},
+		{"empty", math.Exp, 1, 1, 0},
+	}
+	for _, c := range cases {
+		for _, tolerance := range []float64{1e-4, 1e-8, 1e-12} {
+			value, errEst := integrate(c.f, c.a, c.b, tolerance)
+			if errEst > tolerance {
+				t.Errorf("%s: error estimate %g exceeds tolerance %g", c.name, errEst, tolerance)
+			}
+			if math.Abs(value-c.expected) > tolerance {
+				t.Errorf("%s: expected %.15g, got %.15g with tolerance %g",
+					c.name, c.expected, value, tolerance)
+			}
+		}
+	}
+}
+
+// The reference values of the Jaccard similarity probabilities are the
+// exact integrals of the polynomial densities computed using rational
+// arithmetic, and the reference values of the containment probabilities
+// are computed using the composite Simpson's rule with 400000 intervals,
+// which agrees with 200000 intervals to 1e-17.
+func Test_ProbabilitiesReference(t *testing.T) {
+	const tolerance = 1e-10
+	jaccardCases := []struct {
+		k, l   int
+		t      float64
+		fp, fn float64
+	}{
+		{4, 32, 0.5, 0.12647345680463903, 0.0057268452431901429},
+		{2, 8, 0.1, 0.002611458939583128, 0.20214982906618856},
+		{8, 16, 0.9, 0.23697065303589018, 1.0115710345150517e-06},
+		{1, 64, 0.05, 0.035163814342316316, 0.00054842972693169736},
+	}
+	for _, c := range jaccardCases {
+		fp, fn := jaccardProbs(100, 100, 64, c.t, tolerance)(c.l, c.k)
+		if math.Abs(fp-c.fp) > 10*tolerance || math.Abs(fn-c.fn) > 10*tolerance {
+			t.Errorf("Jaccard k = %d, l = %d, t = %g: expected fp = %.15g, fn = %.15g, got %.15g, %.15g",
+				c.k, c.l, c.t, c.fp, c.fn, fp, fn)
+		}
+	}
+	containmentCases := []struct {
+		x, q, l, k int
+		t          float64
+		fp, fn     float64
+	}{
+		{1000, 100, 32, 4, 0.5, 1.594815205063735e-05, 0.4994162893091913},
+		// A small threshold and a small x/q ratio.
+		{10, 1000, 16, 2, 0.005, 6.5833936963574449e-07, 0.0049953538970816625},
+		{100, 100, 8, 2, 0.1, 0.00071570731192818033, 0.34245174904796993},
+		// An extreme x/q ratio.
+		{1000000, 10, 32, 1, 0.9, 0.00012958742969451434, 0.099969604495035905},
+		{50, 100, 4, 4, 0.3, 0.00080222821401514663, 0.18287067348131295},
+	}
+	for _, c := range containmentCases {
+		fp, fn := containmentProbs(c.x, c.q, 64, c.t, tolerance)(c.l, c.k)
+		if math.Abs(fp-c.fp) > 10*tolerance || math.Abs(fn-c.fn) > 10*tolerance {
+			t.Errorf("Containment x = %d, q = %d, k = %d, l = %d, t = %g: expected fp = %.15g, fn = %.15g, got %.15g, %.15g",
+				c.x, c.q, c.k, c.l, c.t, c.fp, c.fn, fp, fn)
+		}
+	}
+}
+
+func Test_CandidateProbability(t *testing.T) {
+	// 1 - (1 - p^k)^l loses all precision in float64 for tiny p^k.
+	p, k, l := 1e-6, 3, 8
+	if got, expected := candidateProbability(p, k, l), 8e-18; math.Abs(got-expected) > 1e-30 {
+		t.Errorf("Expected %g, got %g", expected, got)
+	}
+	if got := candidateProbability(1.0, k, l); got != 1.0 {
+		t.Errorf("Expected 1, got %g", got)
+	}
+	if got := missProbability(1.0, k, l); got != 0.0 {
+		t.Errorf("Expected 0, got %g", got)
+	}
+}
+
+func Test_LshEnsembleIntegrationTolerance(t *testing.T) {
+	index := NewLshEnsemble([]Partition{{1, 10}, {11, 100}}, 128, 4, 2, WithIntegrationTolerance(1e-3))
+	if index.tolerance != 1e-3 {
+		t.Fatalf("Expected tolerance 1e-3, got %g", index.tolerance)
+	}
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var loaded LshEnsemble
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.tolerance != 1e-3 {
+		t.Fatalf("Expected loaded tolerance 1e-3, got %g", loaded.tolerance)
+	}
+	for _, tolerance := range []float64{0, -1, math.Inf(1), math.NaN()} {
+		if defaults := NewLshEnsemble(nil, 128, 4, 2, WithIntegrationTolerance(tolerance)); defaults.tolerance != defaultIntegrationTolerance {
+			t.Fatalf("Expected default tolerance given %g, got %g", tolerance, defaults.tolerance)
+		}
+		// An invalid tolerance in an index file is rejected.
+		index.tolerance = tolerance
+		buf.Reset()
+		if _, err := index.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loaded.ReadFrom(&buf); err == nil {
+			t.Errorf("Expected error loading tolerance %g", tolerance)
+		}
+	}
+}
+
+func Benchmark_OptimalKL(b *testing.B) {
+	f := NewLshForest(4, 64, 1)
+	for i := 0; i < b.N; i++ {
+		f.OptimalKL(1000, 100, 0.5)
+	}
+}
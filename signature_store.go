@@ -0,0 +1,167 @@
+package lshensemble
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errNoSignatureStore = errors.New("Signature store is not enabled for this index, use WithSignatureStore")
+	errDomainNotFound   = errors.New("Domain not found in the signature store")
+)
+
+// ScoredKeyOf is a domain key of type K with its estimated containment
+// score with respect to a query domain.
+type ScoredKeyOf[K comparable] struct {
+	Key   K
+	Score float64
+}
+
+// ScoredKey is a domain key with its estimated containment score
+// with respect to a query domain.
+type ScoredKey = ScoredKeyOf[interface{}]
+
+type storedDomain struct {
+	sig  []uint64
+	size int
+}
+
+// signatureStore retains the signatures and sizes of the indexed domains.
+type signatureStore[K comparable] struct {
+	mu      sync.RWMutex
+	domains map[K]storedDomain
+}
+
+func newSignatureStore[K comparable]() *signatureStore[K] {
+	return &signatureStore[K]{domains: make(map[K]storedDomain)}
+}
+
+// put stores a copy of sig, so the caller can reuse it, e.g., the
+// signature of a Minhash which keeps accepting values.
+func (s *signatureStore[K]) put(key K, sig []uint64, size int) {
+	sig = append([]uint64(nil), sig...)
+	s.mu.Lock()
+	s.domains[key] = storedDomain{sig, size}
+	s.mu.Unlock()
+}
+
+func (s *signatureStore[K]) get(key K) (storedDomain, bool) {
+	s.mu.RLock()
+	d, ok := s.domains[key]
+	s.mu.RUnlock()
+	return d, ok
+}
+
+func (s *signatureStore[K]) remove(key K) {
+	s.mu.Lock()
+	delete(s.domains, key)
+	s.mu.Unlock()
+}
+
+// score returns the estimated containment of the query domain in
+// the domain of key, and false if the domain is not stored.
+func (s *signatureStore[K]) score(key K, sig []uint64, size int) (float64, bool) {
+	d, ok := s.get(key)
+	if !ok {
+		return 0.0, false
+	}
+	return Containment(sig, d.sig, size, d.size), true
+}
+
+// signatureStoreData is the serialized form of signatureStore.
+type signatureStoreData[K comparable] struct {
+	Keys       []K
+	Sizes      []int
+	Signatures [][]uint64
+}
+
+func (s *signatureStore[K]) data() *signatureStoreData[K] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data := &signatureStoreData[K]{
+		Keys:       make([]K, 0, len(s.domains)),
+		Sizes:      make([]int, 0, len(s.domains)),
+		Signatures: make([][]uint64, 0, len(s.domains)),
+	}
+	for key, d := range s.domains {
+		data.Keys = append(data.Keys, key)
+		data.Sizes = append(data.Sizes, d.size)
+		data.Signatures = append(data.Signatures, d.sig)
+	}
+	return data
+}
+
+func (data *signatureStoreData[K]) store() *signatureStore[K] {
+	s := newSignatureStore[K]()
+	for i, key := range data.Keys {
+		s.domains[key] = storedDomain{data.Signatures[i], data.Sizes[i]}
+	}
+	return s
+}
+
+// Domain returns the stored record of the domain of key, and false if
+// the domain is not found in the signature store. The signature of the
+// record is a copy of the stored one.
+// The index must be created with the WithSignatureStore option.
+func (e *LshEnsembleOf[K]) Domain(key K) (*DomainRecordOf[K], bool) {
+	if e.store == nil {
+		return nil, false
+	}
+	d, ok := e.store.get(key)
+	if !ok {
+		return nil, false
+	}
+	sig := append([]uint64(nil), d.sig...)
+	return &DomainRecordOf[K]{Key: key, Size: d.size, Signature: sig}, true
+}
+
+// QueryVerified returns the keys of the candidate domains whose estimated
+// containment of the query domain is no less than the threshold, along
+// with the estimated containment computed using Containment and the
+// stored signatures.
+// This removes most of the false positives returned by Query, at the cost of
+// estimating the containment of every candidate.
+// The index must be created with the WithSignatureStore option.
+func (e *LshEnsembleOf[K]) QueryVerified(sig []uint64, size int, threshold float64) ([]ScoredKeyOf[K], error) {
+	if e.store == nil {
+		return nil, errNoSignatureStore
+	}
+	params := e.computeParams(size, threshold, containmentMeasure, e.objective)
+	done := make(chan struct{})
+	defer close(done)
+	results := make([]ScoredKeyOf[K], 0)
+	for key := range e.queryWithParam(sig, params, done) {
+		score, ok := e.store.score(key, sig, size)
+		if !ok || score < threshold {
+			continue
+		}
+		results = append(results, ScoredKeyOf[K]{key, score})
+	}
+	return results, nil
+}
+
+// QueryByKey returns the keys of the candidate domains containing the
+// indexed domain of key with containment no less than the threshold,
+// using its stored signature and size, e.g., to find the join candidates
+// of an indexed column.
+// The domain of key itself is excluded from the results.
+// The index must be created with the WithSignatureStore option.
+func (e *LshEnsembleOf[K]) QueryByKey(key K, threshold float64) ([]K, error) {
+	if e.store == nil {
+		return nil, errNoSignatureStore
+	}
+	d, ok := e.store.get(key)
+	if !ok {
+		return nil, errDomainNotFound
+	}
+	params := e.computeParams(d.size, threshold, containmentMeasure, e.objective)
+	done := make(chan struct{})
+	defer close(done)
+	results := make([]K, 0)
+	for candidate := range e.queryWithParam(d.sig, params, done) {
+		if candidate != key {
+			results = append(results, candidate)
+		}
+	}
+	return results, nil
+}
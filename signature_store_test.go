@@ -0,0 +1,93 @@
+package lshensemble
+
+import (
+	"strconv"
+	"testing"
+)
+
+func Test_LshEnsembleQueryVerified(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) },
+		WithSignatureStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	threshold := 0.5
+	for _, rec := range recs {
+		stored, ok := index.Domain(rec.Key)
+		if !ok || stored.Size != rec.Size {
+			t.Fatal("domain not stored", rec.Key)
+		}
+		results, err := index.QueryVerified(rec.Signature, rec.Size, threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, result := range results {
+			if result.Score < threshold {
+				t.Fatal("result below threshold", result)
+			}
+			if result.Key == rec.Key {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("unable to retrieve inserted key")
+		}
+	}
+	index.Remove(recs[0].Key)
+	if _, ok := index.Domain(recs[0].Key); ok {
+		t.Fatal("removed domain still stored")
+	}
+
+	// Domains added without their sizes are not stored.
+	index.Add(recs[0].Key, recs[0].Signature, 0)
+	if _, ok := index.Domain(recs[0].Key); ok {
+		t.Fatal("domain added without size is stored")
+	}
+	index.AddWithSize(recs[1].Key, recs[1].Signature, recs[1].Size, 0)
+	if stored, ok := index.Domain(recs[1].Key); !ok || stored.Size != recs[1].Size {
+		t.Fatal("domain added with size not stored")
+	}
+
+	// The stored signature is a copy, so a reused signature buffer,
+	// e.g., of a Minhash pushed more values, does not change it.
+	sig := append([]uint64(nil), recs[2].Signature...)
+	if err := index.Prepare(recs[2].Key, sig, recs[2].Size); err != nil {
+		t.Fatal(err)
+	}
+	copy(sig, recs[3].Signature)
+	if stored, ok := index.Domain(recs[2].Key); !ok || !sameSignature(stored.Signature, recs[2].Signature) {
+		t.Fatal("stored signature changed by the caller")
+	}
+}
+
+func Test_LshEnsembleQueryByKey(t *testing.T) {
+	index := NewLshEnsemble([]Partition{{1, 10}, {11, 100}}, 128, 4, 2, WithSignatureStore())
+	small, large := NewMinhash(1, 128), NewMinhash(1, 128)
+	for i := 0; i < 100; i++ {
+		v := []byte(strconv.Itoa(i))
+		if i < 10 {
+			small.Push(v)
+		}
+		large.Push(v)
+	}
+	index.Prepare("small", small.Signature(), 10)
+	index.Prepare("large", large.Signature(), 100)
+	index.Index()
+	results, err := index.QueryByKey("small", 0.8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != "large" {
+		t.Fatalf("Expected the containing domain only, got %v", results)
+	}
+	if _, err := index.QueryByKey("missing", 0.8); err != errDomainNotFound {
+		t.Fatal("Expected domain not found error, got", err)
+	}
+	noStore := NewLshEnsemble([]Partition{{1, 10}}, 128, 4, 2)
+	if _, err := noStore.QueryByKey("small", 0.8); err != errNoSignatureStore {
+		t.Fatal("Expected no signature store error, got", err)
+	}
+}
@@ -0,0 +1,88 @@
+package lshensemble
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// topKThresholds are the containment thresholds used by TopK in
+// decreasing order, before the last query with the threshold 0.0.
+var topKThresholds = []float64{1.0, 0.75, 0.5, 0.25}
+
+// TopK returns the keys of at most k domains with the highest estimated
+// containment of the query domain, sorted in descending order of the
+// estimated containment, which is computed using Containment and the
+// stored signatures. Domains of the same estimated containment are
+// sorted by their keys.
+// This function is given the MinHash signature of the query domain, sig,
+// the domain size, and k.
+// The index is queried with a decreasing containment threshold, until
+// k candidates with estimated containment no less than the threshold
+// are found, and finally with the threshold 0.0.
+// The index must be created with the WithSignatureStore option.
+func (e *LshEnsembleOf[K]) TopK(sig []uint64, size, k int) ([]ScoredKeyOf[K], error) {
+	if e.store == nil {
+		return nil, errNoSignatureStore
+	}
+	if k <= 0 {
+		return []ScoredKeyOf[K]{}, nil
+	}
+	scored := make(map[K]float64)
+	for _, threshold := range append(topKThresholds, 0.0) {
+		params := e.computeParams(size, threshold, containmentMeasure, e.objective)
+		done := make(chan struct{})
+		for key := range e.queryWithParam(sig, params, done) {
+			if _, seen := scored[key]; seen {
+				continue
+			}
+			if score, ok := e.store.score(key, sig, size); ok {
+				scored[key] = score
+			}
+		}
+		close(done)
+		var numAbove int
+		for _, score := range scored {
+			if score >= threshold {
+				numAbove++
+			}
+		}
+		if numAbove >= k {
+			break
+		}
+	}
+	results := make([]ScoredKeyOf[K], 0, len(scored))
+	for key, score := range scored {
+		results = append(results, ScoredKeyOf[K]{key, score})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return lessKey(results[i].Key, results[j].Key)
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// lessKey orders keys of the same ordered type, i.e., of an integer,
+// floating-point or string kind, by their values, and other keys by
+// their formatted values.
+func lessKey(a, b interface{}) bool {
+	x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+	if x.IsValid() && y.IsValid() && x.Type() == y.Type() {
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return x.Int() < y.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return x.Uint() < y.Uint()
+		case reflect.Float32, reflect.Float64:
+			return x.Float() < y.Float()
+		case reflect.String:
+			return x.String() < y.String()
+		}
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
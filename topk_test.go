@@ -0,0 +1,75 @@
+package lshensemble
+
+import (
+	"testing"
+)
+
+func Test_LshEnsembleTopK(t *testing.T) {
+	recs := testDomainRecords(128)
+	index, err := BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.TopK(recs[0].Signature, recs[0].Size, 1); err != errNoSignatureStore {
+		t.Fatal("expecting signature store error, got", err)
+	}
+
+	index, err = BootstrapLshEnsembleOptimal(2, 128, 4,
+		func() <-chan *DomainRecord { return Recs2Chan(recs) },
+		WithSignatureStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		results, err := index.TopK(rec.Signature, rec.Size, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) == 0 || results[0].Key != rec.Key || results[0].Score != 1.0 {
+			t.Fatal("query domain is not the top result", results)
+		}
+		for i := 1; i < len(results); i++ {
+			if results[i-1].Score < results[i].Score {
+				t.Fatal("results not sorted by score", results)
+			}
+		}
+	}
+}
+
+func Test_LshEnsembleTopKTies(t *testing.T) {
+	index := NewLshEnsemble([]Partition{{1, 10}}, 128, 4, 0, WithSignatureStore())
+	sig := randomSignature(128, 1)
+	// The domains have the same signature and size, so their estimated
+	// containments are equal.
+	for i := 9; i >= 0; i-- {
+		if err := index.Prepare(i, sig, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Index()
+	for i := 0; i < 10; i++ {
+		results, err := index.TopK(sig, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 3 || results[0].Key != 0 || results[1].Key != 1 || results[2].Key != 2 {
+			t.Fatal("ties are not sorted by key", results)
+		}
+	}
+	// Integer keys of other widths are compared by value, not as strings.
+	index32 := NewLshEnsembleOf[uint32]([]Partition{{1, 10}}, 128, 4, 0, WithSignatureStore())
+	for _, key := range []uint32{10, 9, 100} {
+		if err := index32.Prepare(key, sig, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index32.Index()
+	results, err := index32.TopK(sig, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Key != 9 || results[1].Key != 10 || results[2].Key != 100 {
+		t.Fatal("ties of uint32 keys are not sorted by value", results)
+	}
+}
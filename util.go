@@ -1,13 +1,52 @@
 package lshensemble
 
 import (
+	"bytes"
 	"encoding/binary"
 	"sort"
 )
 
 type hashKeyFunc func([]uint64) string
 
-func hashKeyFuncGen(hashValueSize int) hashKeyFunc {
+// validHashValueBits reports whether the hash values can be trimmed to
+// hashValueBits bits, which must be from 1 to 8, or a multiple of 8
+// up to 64.
+func validHashValueBits(hashValueBits int) bool {
+	return hashValueBits >= 1 &&
+		(hashValueBits <= 8 || (hashValueBits%8 == 0 && hashValueBits <= 64))
+}
+
+// hashKeySize returns the number of bytes of a hash key of k hash values
+// trimmed to hashValueBits bits.
+func hashKeySize(k, hashValueBits int) int {
+	return (k*hashValueBits + 7) / 8
+}
+
+// hashKeyFuncGen returns the function concatenating the hash values
+// trimmed to their lowest hashValueBits bits into a hash key.
+// Whole bytes are copied in little-endian order, and hash values of less
+// than 8 bits are packed from the most significant bit of every byte,
+// so the hash key of a prefix of the hash values is always a prefix
+// of the bits of the complete hash key.
+func hashKeyFuncGen(hashValueBits int) hashKeyFunc {
+	if hashValueBits < 8 {
+		mask := uint64(1)<<hashValueBits - 1
+		return func(sig []uint64) string {
+			s := make([]byte, hashKeySize(len(sig), hashValueBits))
+			var pos int
+			for _, v := range sig {
+				v &= mask
+				for j := hashValueBits - 1; j >= 0; j-- {
+					if v>>j&1 == 1 {
+						s[pos/8] |= 0x80 >> (pos % 8)
+					}
+					pos++
+				}
+			}
+			return string(s)
+		}
+	}
+	hashValueSize := hashValueBits / 8
 	return func(sig []uint64) string {
 		s := make([]byte, hashValueSize*len(sig))
 		buf := make([]byte, 8)
@@ -19,12 +58,31 @@ func hashKeyFuncGen(hashValueSize int) hashKeyFunc {
 	}
 }
 
+// comparePrefix compares the first prefixBits bits of the hash keys
+// a and b, both having at least prefixBits bits.
+func comparePrefix(a, b []byte, prefixBits int) int {
+	n := prefixBits / 8
+	c := bytes.Compare(a[:n], b[:n])
+	if c != 0 || prefixBits%8 == 0 {
+		return c
+	}
+	mask := byte(0xff) << (8 - prefixBits%8)
+	x, y := a[n]&mask, b[n]&mask
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
 type sizeCount struct {
 	size  int
 	count int
 }
 
-func computeSizeDistribution(domains <-chan *DomainRecord) (sizes, counts []int) {
+func computeSizeDistribution[K comparable](domains <-chan *DomainRecordOf[K]) (sizes, counts []int) {
 	m := make(map[int]int)
 	for d := range domains {
 		if _, exists := m[d.Size]; !exists {
@@ -32,6 +90,12 @@ func computeSizeDistribution(domains <-chan *DomainRecord) (sizes, counts []int)
 		}
 		m[d.Size]++
 	}
+	return sortSizeCounts(m)
+}
+
+// sortSizeCounts converts the map from domain sizes to counts into
+// slices of sizes and counts sorted by size.
+func sortSizeCounts(m map[int]int) (sizes, counts []int) {
 	sizeCounts := make([]sizeCount, 0, len(m))
 	for size := range m {
 		sizeCounts = append(sizeCounts, sizeCount{size, m[size]})
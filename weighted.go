@@ -0,0 +1,227 @@
+package lshensemble
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+)
+
+// weightedMinWise is a weighted MinHash sketch using Improved Consistent
+// Weighted Sampling (https://doi.org/10.1109/ICDM.2010.80), in which the
+// probability of two sketches having the same i-th hash value is the
+// weighted Jaccard similarity of their multisets.
+type weightedMinWise struct {
+	hash  func([]byte) uint64
+	seeds []uint64
+	// mins are the minimum ICWS values a of the hash functions, and
+	// samples are the hash values of the sampled (value, t) pairs.
+	mins        []float64
+	samples     []uint64
+	totalWeight float64
+	numValues   int
+}
+
+// NewWeightedMinhash initializes a weighted MinHash object with a seed and
+// the number of hash functions, whose values have weights given by
+// PushWeighted, e.g., their frequencies.
+// The signatures estimate the weighted Jaccard similarity, and can be
+// indexed and used in WeightedContainment.
+// Every distinct value must be pushed only once with its total weight.
+// opts are the options to choose the hash family, it panics if given a
+// permutation scheme other than LinearPermutations.
+func NewWeightedMinhash(seed int64, numHash int, opts ...MinhashOption) *Minhash {
+	c := newMinhashConfig(opts)
+	if c.scheme != LinearPermutations {
+		panic("weighted MinHash does not support permutation schemes")
+	}
+	return newMinhash(seed, numHash, sketchWeighted, c.family)
+}
+
+func newWeightedMinWise(r *rand.Rand, family HashFamily, numHash int) *weightedMinWise {
+	h1, _ := seededHashes(r, family)
+	w := &weightedMinWise{
+		hash:    h1,
+		seeds:   make([]uint64, numHash),
+		mins:    make([]float64, numHash),
+		samples: make([]uint64, numHash),
+	}
+	for i := range w.seeds {
+		w.seeds[i] = uint64(r.Int63())
+		w.mins[i] = math.Inf(1)
+		w.samples[i] = maxHashValue
+	}
+	return w
+}
+
+// uniform returns the j-th uniform random number in (0, 1) of the hash
+// value for the i-th hash function.
+func (w *weightedMinWise) uniform(hv uint64, i, j int) float64 {
+	x := splitmix64(hv ^ w.seeds[i] + uint64(j)*0x9e3779b97f4a7c15)
+	return (float64(x>>11) + 0.5) / (1 << 53)
+}
+
+// Push adds a value with weight 1.
+func (w *weightedMinWise) Push(b []byte) {
+	w.pushWeighted(b, 1.0)
+}
+
+func (w *weightedMinWise) pushWeighted(b []byte, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	w.totalWeight += weight
+	w.numValues++
+	hv := w.hash(b)
+	logWeight := math.Log(weight)
+	for i := range w.mins {
+		// r and c follow Gamma(2, 1), and beta follows Uniform(0, 1).
+		r := -math.Log(w.uniform(hv, i, 0) * w.uniform(hv, i, 1))
+		c := -math.Log(w.uniform(hv, i, 2) * w.uniform(hv, i, 3))
+		beta := w.uniform(hv, i, 4)
+		t := math.Floor(logWeight/r + beta)
+		y := math.Exp(r * (t - beta))
+		a := c / (y * math.Exp(r))
+		if a < w.mins[i] {
+			w.mins[i] = a
+			w.samples[i] = splitmix64(hv ^ splitmix64(uint64(int64(t))))
+		}
+	}
+}
+
+func (w *weightedMinWise) Signature() []uint64 {
+	return w.samples
+}
+
+// overlaps returns true if both sketches sampled the same value with the
+// same ICWS value a for a hash function, which means the value was pushed
+// to both with weights of the same sampled quantization t.
+// Values pushed to both are not always detected.
+func (w *weightedMinWise) overlaps(other *weightedMinWise) bool {
+	for i, a := range other.mins {
+		if !math.IsInf(a, 1) && a == w.mins[i] && other.samples[i] == w.samples[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// merge adds the values of other, which must be disjoint from the values
+// of the sketch.
+func (w *weightedMinWise) merge(other *weightedMinWise) {
+	for i, a := range other.mins {
+		if a < w.mins[i] {
+			w.mins[i] = a
+			w.samples[i] = other.samples[i]
+		}
+	}
+	w.totalWeight += other.totalWeight
+	w.numValues += other.numValues
+}
+
+// marshal encodes the state following the samples.
+func (w *weightedMinWise) marshal() []byte {
+	buf := make([]byte, 0, (len(w.mins)+2)*HashValueSize)
+	for _, a := range w.mins {
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(a))
+	}
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(w.totalWeight))
+	return binary.BigEndian.AppendUint64(buf, uint64(w.numValues))
+}
+
+// unmarshal restores the samples and the state encoded by marshal.
+func (w *weightedMinWise) unmarshal(samples []uint64, data []byte) error {
+	if len(data) != (len(w.mins)+2)*HashValueSize {
+		return errMinhashData
+	}
+	copy(w.samples, samples)
+	for i := range w.mins {
+		w.mins[i] = math.Float64frombits(binary.BigEndian.Uint64(data[i*HashValueSize:]))
+	}
+	data = data[len(w.mins)*HashValueSize:]
+	w.totalWeight = math.Float64frombits(binary.BigEndian.Uint64(data))
+	w.numValues = int(binary.BigEndian.Uint64(data[HashValueSize:]))
+	return nil
+}
+
+// PushWeighted adds a value with a weight, e.g., its frequency, to a
+// MinHash object created by NewWeightedMinhash.
+// Every distinct value must be pushed only once with its total weight,
+// and values with non-positive weights are ignored.
+// It panics if the MinHash object is not weighted.
+func (m *Minhash) PushWeighted(b []byte, weight float64) {
+	w, ok := m.sk.(*weightedMinWise)
+	if !ok {
+		panic("PushWeighted requires a Minhash created by NewWeightedMinhash")
+	}
+	w.pushWeighted(b, weight)
+}
+
+// TotalWeight returns the total weight of the values pushed to a
+// weighted MinHash object, or the estimated cardinality if the MinHash
+// object is not weighted.
+func (m *Minhash) TotalWeight() float64 {
+	if w, ok := m.sk.(*weightedMinWise); ok {
+		return w.totalWeight
+	}
+	return float64(m.Cardinality())
+}
+
+// WeightedContainment returns the estimated weighted containment of
+// sum(min(Q(v), X(v))) / sum(Q(v)) over the values v of the multisets.
+// q and x are the signatures of Q and X created by NewWeightedMinhash, and
+// qWeight and xWeight are the total weights of Q and X respectively.
+// If either total weight is 0, the result is defined to be 0.
+func WeightedContainment(q, x []uint64, qWeight, xWeight float64) float64 {
+	if qWeight <= 0 || xWeight <= 0 {
+		return 0.0
+	}
+	// The sum of minimum weights is the weighted Jaccard times the sum of
+	// maximum weights, and the two sums add up to qWeight + xWeight, as
+	// the sizes of the intersection and the union in Containment.
+	return containment(similarityOf(q, x), xWeight/qWeight)
+}
+
+// weightSize converts a total weight into the domain size used to index
+// and query weighted MinHash signatures.
+func weightSize(weight float64) int {
+	if weight < 1.0 {
+		return 1
+	}
+	return int(math.Round(weight))
+}
+
+// NewWeightedDomainRecordOf creates a domain record with a key of type K
+// and the signature of a weighted MinHash object, whose total weight
+// rounded to an integer is used as the domain size.
+// The weights should be scaled so the total weights are not less than 1.
+func NewWeightedDomainRecordOf[K comparable](key K, mh *Minhash) *DomainRecordOf[K] {
+	return &DomainRecordOf[K]{
+		Key:       key,
+		Size:      weightSize(mh.TotalWeight()),
+		Signature: mh.Signature(),
+	}
+}
+
+// NewWeightedDomainRecord creates a domain record with the signature of a
+// weighted MinHash object, whose total weight rounded to an integer is
+// used as the domain size.
+// The weights should be scaled so the total weights are not less than 1.
+func NewWeightedDomainRecord(key interface{}, mh *Minhash) *DomainRecord {
+	return NewWeightedDomainRecordOf(key, mh)
+}
+
+// PrepareWeighted adds a new domain to the index given the signature of its
+// weighted MinHash object and its total weight.
+// See Prepare for details.
+func (e *LshEnsembleOf[K]) PrepareWeighted(key K, sig []uint64, weight float64) error {
+	return e.Prepare(key, sig, weightSize(weight))
+}
+
+// QueryWeighted is similar to Query, but given the signature of the weighted
+// MinHash object of the query domain and its total weight, and the
+// threshold of weighted containment.
+// The indexed domains must be added using PrepareWeighted or
+// NewWeightedDomainRecord.
+func (e *LshEnsembleOf[K]) QueryWeighted(sig []uint64, weight float64, threshold float64, done <-chan struct{}) <-chan K {
+	return e.Query(sig, weightSize(weight), threshold, done)
+}
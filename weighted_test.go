@@ -0,0 +1,135 @@
+package lshensemble
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// weightedData returns n values with weights 1 to 10.
+func weightedData(n int) ([][]byte, []float64) {
+	values := make([][]byte, n)
+	weights := make([]float64, n)
+	for i := range values {
+		values[i] = []byte(strconv.Itoa(i))
+		weights[i] = float64(1 + i%10)
+	}
+	return values, weights
+}
+
+func Test_WeightedMinhash(t *testing.T) {
+	values, weights := weightedData(1000)
+	q := NewWeightedMinhash(1, 256)
+	x := NewWeightedMinhash(1, 256)
+	var minSum, maxSum, qSum float64
+	for i := range values {
+		// Q has the first 600 values, and X has the last 600 values with
+		// half of the weights.
+		var qw, xw float64
+		if i < 600 {
+			qw = weights[i]
+			q.PushWeighted(values[i], qw)
+		}
+		if i >= 400 {
+			xw = weights[i] / 2
+			x.PushWeighted(values[i], xw)
+		}
+		minSum += math.Min(qw, xw)
+		maxSum += math.Max(qw, xw)
+		qSum += qw
+	}
+	if est, act := similarityOf(q.Signature(), x.Signature()), minSum/maxSum; math.Abs(est-act) > 0.05 {
+		t.Errorf("Expected weighted Jaccard close to %f, got %f", act, est)
+	}
+	est := WeightedContainment(q.Signature(), x.Signature(), q.TotalWeight(), x.TotalWeight())
+	if act := minSum / qSum; math.Abs(est-act) > 0.05 {
+		t.Errorf("Expected weighted containment close to %f, got %f", act, est)
+	}
+	if q.TotalWeight() != qSum {
+		t.Errorf("Expected total weight %f, got %f", qSum, q.TotalWeight())
+	}
+	if q.Cardinality() != 600 {
+		t.Errorf("Expected cardinality 600, got %d", q.Cardinality())
+	}
+
+	// Merged and restored sketches are identical to the original.
+	all := NewWeightedMinhash(1, 256)
+	parts := []*Minhash{NewWeightedMinhash(1, 256), NewWeightedMinhash(1, 256)}
+	for i := range values {
+		all.PushWeighted(values[i], weights[i])
+		parts[i%2].PushWeighted(values[i], weights[i])
+	}
+	if err := parts[0].Merge(parts[1]); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := parts[0].MarshalBinary()
+	var restored Minhash
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !sameSignature(restored.Signature(), all.Signature()) || restored.TotalWeight() != all.TotalWeight() {
+		t.Error("Restored merged weighted Minhash is different")
+	}
+	// Merging values pushed to both is an error, which leaves the
+	// MinHash object unchanged.
+	if err := parts[0].Merge(all); err != errWeightedOverlap {
+		t.Errorf("Expected error merging weighted Minhash with the same values, got %v", err)
+	}
+	if parts[0].TotalWeight() != restored.TotalWeight() || parts[0].Cardinality() != restored.Cardinality() {
+		t.Error("Weighted Minhash changed by a failed merge")
+	}
+	// Empty weighted Minhash objects have no values in common.
+	if err := NewWeightedMinhash(1, 256).Merge(NewWeightedMinhash(1, 256)); err != nil {
+		t.Errorf("Unexpected error merging empty weighted Minhash: %v", err)
+	}
+}
+
+func Test_WeightedMinhashPushWeightedPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic for PushWeighted on unweighted Minhash")
+		}
+	}()
+	NewMinhash(1, 16).PushWeighted([]byte("a"), 2.0)
+}
+
+func Test_LshEnsembleQueryWeighted(t *testing.T) {
+	values, weights := weightedData(200)
+	index := NewLshEnsemble([]Partition{{1, 500}, {501, 5000}}, 128, 4, 2)
+	mhs := make([]*Minhash, 2)
+	for i := range mhs {
+		mhs[i] = NewWeightedMinhash(1, 128)
+		for j := 0; j < 50*(i+1); j++ {
+			mhs[i].PushWeighted(values[j], weights[j])
+		}
+		if err := index.PrepareWeighted(i, mhs[i].Signature(), mhs[i].TotalWeight()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Index()
+	done := make(chan struct{})
+	defer close(done)
+	found := make(map[interface{}]bool)
+	for key := range index.QueryWeighted(mhs[0].Signature(), mhs[0].TotalWeight(), 0.9, done) {
+		found[key] = true
+	}
+	// The first domain is contained in the second one.
+	if !found[0] || !found[1] {
+		t.Errorf("Expected both domains to be found, got %v", found)
+	}
+	rec := NewWeightedDomainRecord("a", mhs[1])
+	if rec.Size != int(math.Round(mhs[1].TotalWeight())) {
+		t.Errorf("Expected size %f, got %d", mhs[1].TotalWeight(), rec.Size)
+	}
+	// The Minhash helpers use the total weight of weighted objects.
+	if rec := NewDomainRecord("a", mhs[1]); rec.Size != weightSize(mhs[1].TotalWeight()) {
+		t.Errorf("Expected size %f, got %d", mhs[1].TotalWeight(), rec.Size)
+	}
+	found = make(map[interface{}]bool)
+	for key := range index.QueryMinhash(mhs[0], 0.9, done) {
+		found[key] = true
+	}
+	if !found[0] || !found[1] {
+		t.Errorf("Expected both domains to be found using QueryMinhash, got %v", found)
+	}
+}